@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/radian-software/sleeping-beauty/lib/sleepingd"
+)
+
+const ctlUsage = `usage: sleepingd ctl [--socket PATH] COMMAND [APP]
+
+Commands:
+  status   show whether each application is running, and when it will sleep
+  wake     start the application now, as if traffic had arrived
+  sleep    stop the application now
+  pause    keep the application in its current state until resumed
+  resume   go back to starting and stopping the application automatically
+
+APP may be omitted if only one application is configured.
+
+Options:
+`
+
+func ctlMainE(args []string) error {
+	flags := flag.NewFlagSet("sleepingd ctl", flag.ExitOnError)
+	socket := flags.String(
+		"socket", os.Getenv(sleepingd.EnvPrefix+"CONTROL_SOCKET"),
+		"path to control socket (defaults to $SLEEPING_BEAUTY_CONTROL_SOCKET)",
+	)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), ctlUsage)
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *socket == "" {
+		return fmt.Errorf("control socket not configured, pass --socket")
+	}
+	res, err := sleepingd.SendControlRequest(*socket, &sleepingd.ControlRequest{
+		Command: flags.Arg(0),
+		App:     flags.Arg(1),
+	}, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tPID\tSLEEPS IN")
+	for _, app := range res.Apps {
+		state := "sleeping"
+		if app.Running {
+			state = "running"
+		}
+		if app.Paused {
+			state += " (paused)"
+		}
+		pid := "-"
+		if app.Pid != 0 {
+			pid = fmt.Sprint(app.Pid)
+		}
+		sleepIn := "-"
+		if app.SleepInSeconds != nil {
+			sleepIn = (time.Duration(*app.SleepInSeconds) * time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", app.Name, state, pid, sleepIn)
+	}
+	return w.Flush()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
@@ -8,46 +9,37 @@ import (
 	"github.com/radian-software/sleeping-beauty/lib/sleepingd"
 )
 
-type envConfig struct {
-	Command        string `env:"SLEEPING_BEAUTY_COMMAND,notEmpty"`
-	TimeoutSeconds int    `env:"SLEEPING_BEAUTY_TIMEOUT_SECONDS,required"`
-	CommandPort    int    `env:"SLEEPING_BEAUTY_COMMAND_PORT,required"`
-	ListenPort     int    `env:"SLEEPING_BEAUTY_LISTEN_PORT,required"`
-	ListenHost     string `env:"SLEEPING_BEAUTY_LISTEN_HOST,notEmpty" envDefault:"0.0.0.0"`
-	MetricsPort    int    `env:"SLEEPING_BEAUTY_METRICS_PORT"`
-	MetricsHost    string `env:"SLEEPING_BEAUTY_METRICS_HOST,notEmpty" envDefault:"0.0.0.0"`
-}
-
 func mainE() error {
-	envCfg := envConfig{}
-	if err := env.Parse(&envCfg); err != nil {
-		return err
-	}
-	if envCfg.TimeoutSeconds <= 0 {
-		return fmt.Errorf("invalid timeout: %d", envCfg.TimeoutSeconds)
+	configPath := flag.String("config", "", "path to YAML configuration file (optional)")
+	flag.Parse()
+	if flag.NArg() > 0 {
+		return fmt.Errorf("unexpected argument: %s", flag.Arg(0))
 	}
-	if envCfg.CommandPort <= 0 {
-		return fmt.Errorf("invalid port: %d", envCfg.CommandPort)
+	loadConfig := func() (*sleepingd.Options, error) {
+		return sleepingd.LoadConfig(*configPath, env.ToMap(os.Environ()))
 	}
-	if envCfg.ListenPort <= 0 {
-		return fmt.Errorf("invalid port: %d", envCfg.ListenPort)
-	}
-	if envCfg.MetricsPort < 0 {
-		return fmt.Errorf("invalid port: %d", envCfg.MetricsPort)
+	opts, err := loadConfig()
+	if err != nil {
+		return err
 	}
-	return sleepingd.Main(&sleepingd.Options{
-		Command:        envCfg.Command,
-		TimeoutSeconds: envCfg.TimeoutSeconds,
-		CommandPort:    envCfg.CommandPort,
-		ListenPort:     envCfg.ListenPort,
-		ListenHost:     envCfg.ListenHost,
-		MetricsPort:    envCfg.MetricsPort,
-		MetricsHost:    envCfg.MetricsHost,
-	})
+	return sleepingd.Main(opts, loadConfig)
 }
 
 func main() {
-	if err := mainE(); err != nil {
+	run := mainE
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		run = func() error {
+			return ctlMainE(os.Args[2:])
+		}
+	}
+	if len(os.Args) > 1 && os.Args[1] == sleepingd.ExecWithListenPIDCommand {
+		// Used internally to start commands in handoff mode,
+		// not meant to be run by hand.
+		run = func() error {
+			return sleepingd.ExecWithListenPID(os.Args[2:])
+		}
+	}
+	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, "fatal:", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,966 @@
+package sleepingd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var connectionsClosed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sleepingd_connections_closed_total",
+	Help: "Number of TCP connections closed, by reason (client, upstream, error, idle_timeout, write_timeout, max_age, or denied).",
+}, []string{"app", "reason"})
+
+// App is a single application managed by sleepingd, see NewApp.
+type App struct {
+	proc *SubprocessManager
+	dms  *DeadMansSwitch
+	// proxy is closed, but not nil, while it is being replaced
+	// by Reconfigure.
+	proxy *Proxy
+	// extraProxies are the proxies for opts.ExtraPorts, in the
+	// same order. It is nil while they are being replaced by
+	// Reconfigure.
+	extraProxies []*Proxy
+	wakeQueue    *WakeQueue
+	// ready is set while the subprocess is listening, so that it
+	// can be checked without waiting for the lock.
+	ready atomic.Bool
+
+	// lock must be held to access opts or paused, or to start or
+	// stop the subprocess.
+	lock   sync.Mutex
+	opts   *AppOptions
+	paused bool
+}
+
+// AppStatus describes the state of an App at a point in time, see
+// App.Status.
+type AppStatus struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+	Pid     int    `json:"pid,omitempty"`
+	Paused  bool   `json:"paused"`
+	// SleepInSeconds is the time until the application will be
+	// put to sleep if there is no more traffic. It is nil if the
+	// application is not scheduled to be put to sleep.
+	SleepInSeconds *float64 `json:"sleep_in_seconds,omitempty"`
+}
+
+// NewApp starts a proxy for the application described by opts. The
+// application's command is run when traffic arrives on the proxy,
+// and stopped again after the configured timeout elapses with no
+// traffic. Call Close to stop the proxy and the application.
+func NewApp(opts *AppOptions) (*App, error) {
+	if err := checkCommandFree(opts); err != nil {
+		return nil, err
+	}
+	argv, err := opts.argv()
+	if err != nil {
+		return nil, err
+	}
+	app := &App{
+		opts: opts,
+		proc: &SubprocessManager{
+			Name:                   opts.Name,
+			Command:                argv,
+			Dir:                    opts.Dir,
+			Protocol:               opts.Protocol,
+			Host:                   opts.CommandHost,
+			Socket:                 opts.CommandSocket,
+			ExtraPorts:             opts.readyExtraPorts(),
+			TerminationGracePeriod: 5 * time.Second,
+			EnsureListeningTimeout: 5 * time.Second,
+		},
+	}
+	app.dms = NewDeadMansSwitch(time.Duration(opts.TimeoutSeconds)*time.Second, 1*time.Second, app.sleep)
+	app.wakeQueue = NewWakeQueue(opts.Name, opts.MaxPendingConnections, time.Duration(opts.MaxWakeWaitSeconds)*time.Second)
+	proxyOpts, err := app.proxyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	app.proxy, err = openProxy(opts, proxyOpts)
+	if err != nil {
+		return nil, err
+	}
+	app.extraProxies, err = openExtraProxies(opts, proxyOpts)
+	if err != nil {
+		LogError(app.proxy.Close())
+		return nil, err
+	}
+	app.logListening()
+	return app, nil
+}
+
+// argv returns the command line to run for the application. In
+// handoff mode, the command is run through sleepingd itself, see
+// ExecWithListenPID.
+func (opts *AppOptions) argv() ([]string, error) {
+	argv, err := opts.Command.Argv(opts.Shell)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Mode != "handoff" {
+		return argv, nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{self, ExecWithListenPIDCommand}, argv...), nil
+}
+
+func checkCommandFree(opts *AppOptions) error {
+	if opts.Mode == "handoff" {
+		// The command does not listen on its own.
+		return nil
+	}
+	inUse := false
+	if opts.CommandSocket != "" {
+		inUse = socketInUse(opts.CommandSocket)
+	} else {
+		inUse = portInUse(opts.Protocol, opts.CommandHost, opts.CommandPort)
+	}
+	if inUse {
+		// Command is already running somewhere else? This
+		// will screw things up, abort.
+		return fmt.Errorf("something is already listening on %s", describeAddr(opts.upstreamAddr()))
+	}
+	for _, m := range opts.ExtraPorts {
+		if portInUse(opts.Protocol, opts.CommandHost, m.CommandPort) {
+			return fmt.Errorf("something is already listening on %s", describeAddr(opts.extraUpstreamAddr(m)))
+		}
+	}
+	return nil
+}
+
+// listenAddr returns the protocol and address that the proxy for the
+// application listens on.
+func (opts *AppOptions) listenAddr() (string, string) {
+	if opts.ListenFDName != "" {
+		return "systemd", opts.ListenFDName
+	}
+	if opts.ListenSocket != "" {
+		return "unix", opts.ListenSocket
+	}
+	return opts.Protocol, net.JoinHostPort(opts.ListenHost, strconv.Itoa(opts.ListenPort))
+}
+
+// upstreamAddr returns the protocol and address that the command
+// listens on.
+func (opts *AppOptions) upstreamAddr() (string, string) {
+	if opts.CommandSocket != "" {
+		return "unix", opts.CommandSocket
+	}
+	return opts.Protocol, net.JoinHostPort(opts.CommandHost, strconv.Itoa(opts.CommandPort))
+}
+
+// extraListenAddr and extraUpstreamAddr are like listenAddr and
+// upstreamAddr, but for one of opts.ExtraPorts.
+func (opts *AppOptions) extraListenAddr(m PortMapping) (string, string) {
+	return opts.Protocol, net.JoinHostPort(opts.ListenHost, strconv.Itoa(m.ListenPort))
+}
+
+func (opts *AppOptions) extraUpstreamAddr(m PortMapping) (string, string) {
+	return opts.Protocol, net.JoinHostPort(opts.CommandHost, strconv.Itoa(m.CommandPort))
+}
+
+// extraCommandPorts returns the command ports of opts.ExtraPorts, and
+// readyExtraPorts only those that are not optional, which the
+// command must listen on before it is ready.
+func (opts *AppOptions) extraCommandPorts() []int {
+	ports := []int{}
+	for _, m := range opts.ExtraPorts {
+		ports = append(ports, m.CommandPort)
+	}
+	return ports
+}
+
+func (opts *AppOptions) readyExtraPorts() []int {
+	ports := []int{}
+	for _, m := range opts.ExtraPorts {
+		if !m.Optional {
+			ports = append(ports, m.CommandPort)
+		}
+	}
+	return ports
+}
+
+// describeAddr formats a protocol and address for log messages.
+func describeAddr(protocol string, addr string) string {
+	switch protocol {
+	case "unix":
+		return "unix:" + addr
+	case "systemd":
+		return "systemd:" + addr
+	case "udp":
+		return addr + " (udp)"
+	default:
+		return addr
+	}
+}
+
+// httpOptions returns the options for HTTP mode, or nil if the
+// application does not use HTTP mode.
+func httpOptions(opts *AppOptions) (*HTTPOptions, error) {
+	if opts.Mode != "http" {
+		return nil, nil
+	}
+	httpOpts := &HTTPOptions{
+		WakeTimeout: time.Duration(opts.HTTPWakeTimeoutSeconds) * time.Second,
+		RetryAfter:  time.Duration(opts.HTTPRetryAfterSeconds) * time.Second,
+
+		HealthCheckStatus: opts.HealthCheckStatus,
+		HealthCheckBody:   []byte(opts.HealthCheckBody),
+	}
+	if opts.HTTPWakeResponse == "immediate" {
+		httpOpts.WakeTimeout = 0
+	}
+	for _, hc := range opts.HealthChecks {
+		healthCheck, err := ParseHealthCheck(hc)
+		if err != nil {
+			return nil, err
+		}
+		httpOpts.HealthChecks = append(httpOpts.HealthChecks, healthCheck)
+	}
+	if opts.HTTPWakingPage != "" {
+		page, err := os.ReadFile(opts.HTTPWakingPage)
+		if err != nil {
+			return nil, err
+		}
+		httpOpts.WakingPage = page
+	}
+	return httpOpts, nil
+}
+
+// tlsConfig returns the configuration for TLS termination, or nil if
+// the application does not use TLS.
+func tlsConfig(opts *AppOptions) (*tls.Config, error) {
+	if opts.TLSCertFile == "" {
+		return nil, nil
+	}
+	alpn := opts.TLSALPN
+	if alpn == nil && opts.Mode == "http" {
+		alpn = []string{"h2", "http/1.1"}
+	}
+	return NewTLSConfig(opts.TLSCertFile, opts.TLSKeyFile, opts.TLSMinVersion, alpn)
+}
+
+func (a *App) proxyOptions(opts *AppOptions) (*ProxyOptions, error) {
+	mode, err := ParseSocketMode(opts.ListenSocketMode)
+	if err != nil {
+		return nil, err
+	}
+	httpOpts, err := httpOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf, err := tlsConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	connectFrom, err := ParseClientRules(opts.ConnectFrom)
+	if err != nil {
+		return nil, err
+	}
+	wakeFrom, err := ParseClientRules(opts.WakeFrom)
+	if err != nil {
+		return nil, err
+	}
+	keepAwakeFrom, err := ParseClientRules(opts.KeepAwakeFrom)
+	if err != nil {
+		return nil, err
+	}
+	protocol, listenAddr := opts.listenAddr()
+	upstreamProtocol, upstreamAddr := opts.upstreamAddr()
+	sendProxyHeader := 0
+	switch opts.SendProxyProtocol {
+	case "v1":
+		sendProxyHeader = 1
+	case "v2":
+		sendProxyHeader = 2
+	}
+	proxyOpts := &ProxyOptions{
+		Protocol:              protocol,
+		ListenAddr:            listenAddr,
+		UpstreamProtocol:      upstreamProtocol,
+		UpstreamAddr:          upstreamAddr,
+		SocketMode:            mode,
+		SocketOwner:           opts.ListenSocketOwner,
+		NewConnectionCallback: a.wake,
+		ReadyCallback:         a.ready.Load,
+		WakeQueue:             a.wakeQueue,
+		DataCallback:          a.dms.Ping,
+		SessionTimeout:        time.Duration(opts.UDPSessionTimeoutSeconds) * time.Second,
+		HTTP:                  httpOpts,
+		SendProxyHeader:       sendProxyHeader,
+		AcceptProxyHeader:     opts.AcceptProxyProtocol,
+		HalfClose:             opts.HalfClose,
+		IdleTimeout:           time.Duration(opts.ConnectionIdleTimeoutSeconds) * time.Second,
+		WriteTimeout:          time.Duration(opts.ConnectionWriteTimeoutSeconds) * time.Second,
+		MaxAge:                time.Duration(opts.ConnectionMaxAgeSeconds) * time.Second,
+		KeepAlive:             time.Duration(opts.TCPKeepAliveSeconds) * time.Second,
+		WakeOnConnect:         opts.WakeOnConnect,
+		WakeOnConnectGrace:    time.Duration(opts.WakeOnConnectGraceMilliseconds) * time.Millisecond,
+		DialAttempts:          opts.DialAttempts,
+		DialBackoff:           time.Duration(opts.DialBackoffMilliseconds) * time.Millisecond,
+		DialTimeout:           time.Duration(opts.DialTimeoutSeconds) * time.Second,
+		ConnectFrom:           connectFrom,
+		WakeFrom:              wakeFrom,
+		KeepAwakeFrom:         keepAwakeFrom,
+		ClosedCallback:        a.connectionClosed,
+		TLS:                   tlsConf,
+	}
+	if opts.Mode == "handoff" {
+		// Traffic does not go through the proxy, so the
+		// application decides for itself when to exit.
+		proxyOpts.NewConnectionCallback = nil
+		proxyOpts.DataCallback = nil
+		proxyOpts.Handoff = a.handoff
+	}
+	return proxyOpts, nil
+}
+
+// connectionClosed counts a closed connection in the metrics, see
+// ProxyOptions.ClosedCallback.
+func (a *App) connectionClosed(reason string) {
+	connectionsClosed.WithLabelValues(a.Name(), reason).Inc()
+}
+
+// routed reports whether the application shares its listen address
+// with others, see ListenRouted.
+func (opts *AppOptions) routed() bool {
+	return len(opts.Hostnames) > 0 || opts.DefaultRoute
+}
+
+// openProxy starts a proxy for the application with the given
+// options. If the application listens on a socket passed by systemd,
+// then that socket is used. If the application is routed by
+// hostname, then the listener is shared with the other applications
+// on the same address.
+func openProxy(opts *AppOptions, proxyOpts *ProxyOptions) (*Proxy, error) {
+	actualOpts := *proxyOpts
+	if opts.ListenFDName != "" {
+		actualOpts.Protocol = opts.Protocol
+		var err error
+		if opts.Protocol == "udp" {
+			actualOpts.PacketConn, err = ActivationPacketConn(opts.ListenFDName)
+		} else {
+			actualOpts.Listener, err = ActivationListener(opts.ListenFDName)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.routed() {
+		l, err := ListenRouted(&RouteOptions{
+			Protocol:          proxyOpts.Protocol,
+			ListenAddr:        proxyOpts.ListenAddr,
+			Listener:          actualOpts.Listener,
+			SocketMode:        proxyOpts.SocketMode,
+			SocketOwner:       proxyOpts.SocketOwner,
+			AcceptProxyHeader: proxyOpts.AcceptProxyHeader,
+			Hostnames:         opts.Hostnames,
+			Default:           opts.DefaultRoute,
+		})
+		if err != nil {
+			return nil, err
+		}
+		actualOpts.Listener = l
+		// Handled by the shared listener
+		actualOpts.AcceptProxyHeader = false
+	}
+	p, err := NewProxy(&actualOpts)
+	if err != nil {
+		if actualOpts.Listener != nil {
+			LogError(actualOpts.Listener.Close())
+		}
+		if actualOpts.PacketConn != nil {
+			LogError(actualOpts.PacketConn.Close())
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// openExtraProxies starts a proxy for each of opts.ExtraPorts, with
+// the same callbacks as proxyOpts, and the same client rules unless
+// the port mapping has its own. They are always in raw mode. If an
+// error is returned, then none of them are left open.
+func openExtraProxies(opts *AppOptions, proxyOpts *ProxyOptions) ([]*Proxy, error) {
+	proxies := []*Proxy{}
+	for _, m := range opts.ExtraPorts {
+		extraOpts := *proxyOpts
+		extraOpts.Protocol, extraOpts.ListenAddr = opts.extraListenAddr(m)
+		extraOpts.UpstreamProtocol, extraOpts.UpstreamAddr = opts.extraUpstreamAddr(m)
+		extraOpts.HTTP = nil
+		extraOpts.TLS = nil
+		extraOpts.WakeOnConnect = m.WakeOnConnect
+		err := overrideClientRules(&extraOpts, m)
+		if err != nil {
+			closeProxies(proxies)
+			return nil, err
+		}
+		p, err := NewProxy(&extraOpts)
+		if err != nil {
+			closeProxies(proxies)
+			return nil, err
+		}
+		proxies = append(proxies, p)
+	}
+	return proxies, nil
+}
+
+// overrideClientRules replaces the client rules in proxyOpts with
+// those of m, where set.
+func overrideClientRules(proxyOpts *ProxyOptions, m PortMapping) error {
+	for _, override := range []struct {
+		rules  []string
+		target **ClientRules
+	}{
+		{m.ConnectFrom, &proxyOpts.ConnectFrom},
+		{m.WakeFrom, &proxyOpts.WakeFrom},
+		{m.KeepAwakeFrom, &proxyOpts.KeepAwakeFrom},
+	} {
+		if override.rules == nil {
+			continue
+		}
+		rules, err := ParseClientRules(override.rules)
+		if err != nil {
+			return err
+		}
+		*override.target = rules
+	}
+	return nil
+}
+
+func closeProxies(proxies []*Proxy) {
+	for _, p := range proxies {
+		LogError(p.Close())
+	}
+}
+
+func (a *App) logListening() {
+	command := fmt.Sprintf("exec form command line: %q", a.proc.Command)
+	if a.opts.Command.Args == nil {
+		command = fmt.Sprintf("%s command line: %s", a.proc.Command[0], a.opts.Command.Script)
+	}
+	if a.opts.Mode == "handoff" {
+		a.log("listening on %s, handing off to %s", describeAddr(a.opts.listenAddr()), command)
+		return
+	}
+	a.log("listening on %s, proxying to %s with %s", describeAddr(a.opts.listenAddr()), describeAddr(a.opts.upstreamAddr()), command)
+	for _, m := range a.opts.ExtraPorts {
+		a.log("also listening on %s, proxying to %s", describeAddr(a.opts.extraListenAddr(m)), describeAddr(a.opts.extraUpstreamAddr(m)))
+	}
+}
+
+// wake starts the application if it is not already running, and
+// waits for it to be ready to receive traffic. If it has exited on
+// its own since it was started, then it is started again. If the
+// application is paused, then it is not started. If it fails to
+// start, then the error is logged and returned, and the application
+// is stopped again, so that the next connection tries again.
+func (a *App) wake() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if exited := a.proc.Exited(); exited != nil && a.opts.Mode != "handoff" {
+		select {
+		case <-exited:
+			// Clean up, so that it is started again below.
+			a.log("subprocess exited unexpectedly")
+			LogError(a.stop())
+		default:
+		}
+	}
+	if a.paused && a.proc.Pid() == 0 {
+		return nil
+	}
+	if err := a.start(); err != nil {
+		err = fmt.Errorf("[%s] %w", a.Name(), err)
+		LogError(err)
+		LogError(a.stop())
+		return err
+	}
+	return nil
+}
+
+// sleep stops the application if it is running, unless it is paused.
+// Errors are logged, since there is nobody to return them to.
+func (a *App) sleep() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.paused {
+		return
+	}
+	if err := a.stop(); err != nil {
+		LogError(fmt.Errorf("[%s] %w", a.Name(), err))
+	}
+}
+
+// handoff starts the application with the listening socket f, in
+// handoff mode, see ProxyOptions.Handoff. It returns a channel that
+// is closed once the application has exited, or nil if it was not
+// started.
+func (a *App) handoff(p *Proxy, f *os.File) <-chan struct{} {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.paused || p.Closed() {
+		// The proxy may have been replaced by
+		// Reconfigure while waiting for the lock.
+		return nil
+	}
+	a.proc.ExtraFiles = []*os.File{f}
+	err := a.start()
+	a.proc.ExtraFiles = nil
+	if err != nil {
+		LogError(fmt.Errorf("[%s] %w", a.Name(), err))
+		LogError(a.stop())
+		return nil
+	}
+	exited := a.proc.Exited()
+	done := make(chan struct{})
+	go func() {
+		<-exited
+		a.lock.Lock()
+		if a.proc.Exited() == exited {
+			// Exited on its own, rather than being
+			// stopped.
+			a.log("subprocess exited, listening again")
+			LogError(a.stop())
+		}
+		a.lock.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// start must be called with the lock held.
+func (a *App) start() error {
+	if a.proc.Pid() == 0 {
+		// Environment files are re-read every time the
+		// subprocess is started, so changes to them take
+		// effect without reloading sleepingd.
+		env, err := ChildEnvironment(a.opts, os.Environ())
+		if err != nil {
+			return err
+		}
+		if a.opts.Mode == "handoff" {
+			env = handoffEnvironment(env, a.Name())
+		}
+		a.proc.Env = env
+		// Some applications refuse to start if their socket
+		// file was left behind by a previous run.
+		if a.opts.CommandSocket != "" {
+			if err := removeStaleSocket(a.opts.CommandSocket); err != nil {
+				return err
+			}
+		}
+	}
+	if err := a.proc.EnsureStarted(); err != nil {
+		return err
+	}
+	if a.opts.Mode == "handoff" {
+		// Connections wait in the socket's queue until the
+		// subprocess accepts them.
+		a.ready.Store(true)
+		return nil
+	}
+	if err := a.proc.EnsureListening(a.opts.CommandPort); err != nil {
+		return err
+	}
+	a.ready.Store(true)
+	a.dms.Ping()
+	return nil
+}
+
+// stop must be called with the lock held.
+func (a *App) stop() error {
+	a.ready.Store(false)
+	defer a.proxy.CloseIdleConnections()
+	for _, p := range append([]*Proxy{a.proxy}, a.extraProxies...) {
+		p.CloseSessions()
+	}
+	if err := a.proc.EnsureStopped(); err != nil {
+		return err
+	}
+	if a.opts.Mode == "handoff" {
+		// The listening socket belongs to sleepingd, so there
+		// is nothing to wait for.
+		return nil
+	}
+	return a.proc.EnsureNotListening(a.opts.CommandPort)
+}
+
+// Status returns the current state of the application.
+func (a *App) Status() *AppStatus {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	status := &AppStatus{
+		Name:    a.Name(),
+		Pid:     a.proc.Pid(),
+		Running: a.proc.Pid() != 0,
+		Paused:  a.paused,
+	}
+	if remaining, ok := a.dms.Remaining(); ok && status.Running && !a.paused {
+		seconds := remaining.Seconds()
+		status.SleepInSeconds = &seconds
+	}
+	return status
+}
+
+// ForceWake starts the application and waits for it to be ready, as
+// if traffic had arrived, even if it is paused. It is then put to
+// sleep after the usual timeout if there is no traffic.
+func (a *App) ForceWake() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.opts.Mode == "handoff" {
+		return fmt.Errorf("[%s] cannot wake up on request in handoff mode, since the listening socket is only handed over when a connection arrives", a.Name())
+	}
+	a.log("waking up on request")
+	return a.start()
+}
+
+// ForceSleep stops the application immediately, even if it is paused
+// or there is active traffic. It is started again when new traffic
+// arrives, unless it is paused.
+func (a *App) ForceSleep() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.log("going to sleep on request")
+	return a.stop()
+}
+
+// Pause keeps the application in its current state until Resume is
+// called: if it is running, it is not put to sleep when the timeout
+// expires, and if it is stopped, it is not woken up by traffic
+// (connections are closed instead).
+func (a *App) Pause() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.log("paused")
+	a.paused = true
+}
+
+// Resume undoes Pause. If the application is running, then the
+// timeout starts again from now.
+func (a *App) Resume() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.log("resumed")
+	a.paused = false
+	if a.proc.Pid() != 0 {
+		a.dms.Ping()
+	}
+}
+
+func (a *App) log(format string, args ...interface{}) {
+	Log("["+a.Name()+"] "+format, args...)
+}
+
+// Name returns the name of the application. It does not change when
+// the application is reconfigured.
+func (a *App) Name() string {
+	return a.proc.Name
+}
+
+// Reconfigure applies new options to a running application. Options
+// that can be changed live, like the timeout, are applied without
+// interruption. If the command or command port has changed, then the
+// subprocess is stopped, and it is started again using the new
+// options when traffic next arrives. If the listen address or other
+// settings of the listener have changed, like the mode, then the
+// listener is closed and reopened, so there is a brief interruption;
+// connections that were already accepted are unaffected. When
+// reconfiguring several applications, call CloseChangedListeners on
+// all of them first, so that they can swap addresses. If an error is
+// returned, then the application continues to run using its previous
+// options.
+func (a *App) Reconfigure(opts *AppOptions) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.closeChangedListeners(opts)
+	old := a.opts
+	var newProxy *Proxy
+	var newExtraProxies []*Proxy
+	fail := func(err error) error {
+		if newProxy != nil {
+			LogError(newProxy.Close())
+		}
+		closeProxies(newExtraProxies)
+		a.reopenListeners(old)
+		return fmt.Errorf("[%s] failed to reconfigure: %w", a.Name(), err)
+	}
+	proxyOpts, err := a.proxyOptions(opts)
+	if err != nil {
+		return fail(err)
+	}
+	if !a.proxy.Closed() && opts.ListenSocket != "" && (opts.ListenSocketMode != old.ListenSocketMode || opts.ListenSocketOwner != old.ListenSocketOwner) {
+		// Same socket, so it can be updated in place.
+		mode, err := ParseSocketMode(opts.ListenSocketMode)
+		if err != nil {
+			return fail(err)
+		}
+		if err := setSocketPermissions(opts.ListenSocket, mode, opts.ListenSocketOwner); err != nil {
+			return fail(err)
+		}
+	}
+	if a.proxy.Closed() {
+		newProxy, err = openProxy(opts, proxyOpts)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if a.extraProxies == nil {
+		newExtraProxies, err = openExtraProxies(opts, proxyOpts)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	restart := processOptionsChanged(old, opts)
+	if old.Mode == "handoff" && a.proxy.Closed() {
+		// The subprocess has the old listening socket.
+		restart = true
+	}
+	if restart {
+		argv, err := opts.argv()
+		if err != nil {
+			return fail(err)
+		}
+		if describeAddr(opts.upstreamAddr()) != describeAddr(old.upstreamAddr()) {
+			if err := checkCommandFree(opts); err != nil {
+				return fail(err)
+			}
+		}
+		if err := a.stop(); err != nil {
+			return fail(err)
+		}
+		a.proc.Command = argv
+		a.proc.Dir = opts.Dir
+		a.proc.Protocol = opts.Protocol
+		a.proc.Host = opts.CommandHost
+		a.proc.Socket = opts.CommandSocket
+		a.proxy.SetUpstream(opts.upstreamAddr())
+	}
+	if newProxy != nil {
+		a.proxy = newProxy
+	}
+	if newExtraProxies != nil {
+		a.extraProxies = newExtraProxies
+	}
+	a.proc.ExtraPorts = opts.readyExtraPorts()
+	if opts.TimeoutSeconds != old.TimeoutSeconds {
+		a.dms.SetTimeout(time.Duration(opts.TimeoutSeconds) * time.Second)
+	}
+	if opts.MaxPendingConnections != old.MaxPendingConnections || opts.MaxWakeWaitSeconds != old.MaxWakeWaitSeconds {
+		a.wakeQueue.SetLimits(opts.MaxPendingConnections, time.Duration(opts.MaxWakeWaitSeconds)*time.Second)
+	}
+	if opts.UDPSessionTimeoutSeconds != old.UDPSessionTimeoutSeconds {
+		a.proxy.SetSessionTimeout(time.Duration(opts.UDPSessionTimeoutSeconds) * time.Second)
+		for _, p := range a.extraProxies {
+			p.SetSessionTimeout(time.Duration(opts.UDPSessionTimeoutSeconds) * time.Second)
+		}
+	}
+	a.proxy.SetHTTPOptions(proxyOpts.HTTP)
+	a.opts = opts
+	if !reflect.DeepEqual(opts, old) {
+		a.logListening()
+	}
+	return nil
+}
+
+// CloseChangedListeners closes the listeners of the application that
+// Reconfigure would replace for opts, so that other applications can
+// take over their addresses. Reconfigure must be called afterwards to
+// open the new listeners.
+func (a *App) CloseChangedListeners(opts *AppOptions) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.closeChangedListeners(opts)
+}
+
+// closeChangedListeners must be called with the lock held. It does
+// nothing for listeners that are already closed.
+func (a *App) closeChangedListeners(opts *AppOptions) {
+	if !a.proxy.Closed() && (listenOptionsChanged(a.opts, opts) || proxySettingsChanged(a.opts, opts)) {
+		LogError(a.proxy.Close())
+		if a.opts.Mode == "handoff" {
+			// The subprocess has a copy of the listening
+			// socket, so the address is only free once it
+			// has stopped.
+			LogError(a.stop())
+		}
+	}
+	if a.extraProxies != nil && extraProxiesChanged(a.opts, opts) {
+		closeProxies(a.extraProxies)
+		a.extraProxies = nil
+	}
+}
+
+// reopenListeners must be called with the lock held. It opens the
+// listeners closed by closeChangedListeners again using opts, after
+// Reconfigure has failed. Errors are logged, since the application
+// keeps running either way.
+func (a *App) reopenListeners(opts *AppOptions) {
+	proxyOpts, err := a.proxyOptions(opts)
+	if err != nil {
+		LogError(err)
+		return
+	}
+	if a.proxy.Closed() {
+		if p, err := openProxy(opts, proxyOpts); err != nil {
+			LogError(fmt.Errorf("[%s] failed to reopen listener: %w", a.Name(), err))
+		} else {
+			a.proxy = p
+		}
+	}
+	if a.extraProxies == nil {
+		a.extraProxies, err = openExtraProxies(opts, proxyOpts)
+		if err != nil {
+			LogError(fmt.Errorf("[%s] failed to reopen listeners: %w", a.Name(), err))
+		}
+	}
+}
+
+// listenOptionsChanged reports whether the address that the proxy
+// listens on, or the hostnames it is routed, differ between old and
+// opts, in which case a new proxy has to be started.
+func listenOptionsChanged(old *AppOptions, opts *AppOptions) bool {
+	if describeAddr(opts.listenAddr()) != describeAddr(old.listenAddr()) {
+		return true
+	}
+	return opts.routed() && old.routed() &&
+		(!slices.Equal(opts.Hostnames, old.Hostnames) || opts.DefaultRoute != old.DefaultRoute)
+}
+
+// proxySettingsChanged reports whether any of the options that are
+// fixed when the proxy is started differ between old and opts, other
+// than the listen address, see listenOptionsChanged.
+func proxySettingsChanged(old *AppOptions, opts *AppOptions) bool {
+	return opts.routed() != old.routed() ||
+		opts.Mode != old.Mode ||
+		opts.SendProxyProtocol != old.SendProxyProtocol ||
+		opts.AcceptProxyProtocol != old.AcceptProxyProtocol ||
+		connectionSettingsChanged(old, opts) ||
+		opts.TLSCertFile != old.TLSCertFile ||
+		opts.TLSKeyFile != old.TLSKeyFile ||
+		opts.TLSMinVersion != old.TLSMinVersion ||
+		!slices.Equal(opts.TLSALPN, old.TLSALPN)
+}
+
+// extraProxiesChanged reports whether any of the options for the
+// proxies of ExtraPorts differ between old and opts, in which case
+// they have to be restarted.
+func extraProxiesChanged(old *AppOptions, opts *AppOptions) bool {
+	return !slices.EqualFunc(opts.ExtraPorts, old.ExtraPorts, PortMapping.equal) ||
+		opts.ListenHost != old.ListenHost ||
+		opts.CommandHost != old.CommandHost ||
+		opts.Protocol != old.Protocol ||
+		opts.SendProxyProtocol != old.SendProxyProtocol ||
+		opts.AcceptProxyProtocol != old.AcceptProxyProtocol ||
+		connectionSettingsChanged(old, opts)
+}
+
+// connectionSettingsChanged reports whether any of the options for
+// handling client connections differ between old and opts.
+func connectionSettingsChanged(old *AppOptions, opts *AppOptions) bool {
+	return opts.HalfClose != old.HalfClose ||
+		opts.ConnectionIdleTimeoutSeconds != old.ConnectionIdleTimeoutSeconds ||
+		opts.ConnectionWriteTimeoutSeconds != old.ConnectionWriteTimeoutSeconds ||
+		opts.ConnectionMaxAgeSeconds != old.ConnectionMaxAgeSeconds ||
+		opts.TCPKeepAliveSeconds != old.TCPKeepAliveSeconds ||
+		opts.WakeOnConnect != old.WakeOnConnect ||
+		opts.WakeOnConnectGraceMilliseconds != old.WakeOnConnectGraceMilliseconds ||
+		opts.DialAttempts != old.DialAttempts ||
+		opts.DialBackoffMilliseconds != old.DialBackoffMilliseconds ||
+		opts.DialTimeoutSeconds != old.DialTimeoutSeconds ||
+		!slices.Equal(opts.ConnectFrom, old.ConnectFrom) ||
+		!slices.Equal(opts.WakeFrom, old.WakeFrom) ||
+		!slices.Equal(opts.KeepAwakeFrom, old.KeepAwakeFrom)
+}
+
+// processOptionsChanged reports whether any of the options that
+// affect the subprocess differ between old and opts, in which case
+// the subprocess has to be restarted for them to take effect.
+func processOptionsChanged(old *AppOptions, opts *AppOptions) bool {
+	return !opts.Command.Equal(old.Command) ||
+		opts.Shell != old.Shell ||
+		opts.CommandPort != old.CommandPort ||
+		opts.CommandHost != old.CommandHost ||
+		opts.CommandSocket != old.CommandSocket ||
+		!slices.Equal(opts.extraCommandPorts(), old.extraCommandPorts()) ||
+		opts.Protocol != old.Protocol ||
+		(opts.Mode == "handoff") != (old.Mode == "handoff") ||
+		opts.Dir != old.Dir ||
+		!reflect.DeepEqual(opts.Env, old.Env) ||
+		!slices.Equal(opts.UnsetEnv, old.UnsetEnv) ||
+		!slices.Equal(opts.EnvFiles, old.EnvFiles) ||
+		!slices.Equal(opts.EnvAllowlist, old.EnvAllowlist)
+}
+
+// Drain stops accepting new connections for the application, waits
+// for the connections in progress to finish, and then stops its
+// subprocess if it is running. If ctx is done before the connections
+// have finished, then the subprocess is stopped anyway.
+func (a *App) Drain(ctx context.Context) error {
+	a.lock.Lock()
+	proxies := append([]*Proxy{a.proxy}, a.extraProxies...)
+	a.lock.Unlock()
+	for _, p := range proxies {
+		LogError(p.Close())
+	}
+	active := func() int {
+		n := 0
+		for _, p := range proxies {
+			n += p.ActiveConnections()
+		}
+		drainConnections.WithLabelValues(a.Name()).Set(float64(n))
+		return n
+	}
+	if n := active(); n > 0 {
+		a.log("draining %d connections", n)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+	wait:
+		for active() > 0 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				break wait
+			}
+		}
+		if n := active(); n > 0 {
+			a.log("stopping with %d connections still open", n)
+		} else {
+			a.log("all connections finished")
+		}
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.proc.EnsureStopped()
+}
+
+// Close stops accepting new connections for the application, and
+// stops its subprocess if it is running.
+func (a *App) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	err := a.proxy.Close()
+	closeProxies(a.extraProxies)
+	if stopErr := a.proc.EnsureStopped(); stopErr != nil {
+		return stopErr
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package sleepingd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// errWakeDenied is returned by wakeUpstream if the client is not
+// allowed to wake the upstream, see ProxyOptions.WakeFrom.
+var errWakeDenied = errors.New("client is not allowed to wake the application")
+
+// ClientRules decides which clients are allowed based on their IP
+// address, see ParseClientRules. A nil *ClientRules allows all
+// clients.
+type ClientRules struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// ParseClientRules parses a list of rules, each of which is an IP
+// address or a CIDR range such as "10.8.0.0/16", optionally prefixed
+// with "!" to deny it rather than allow it. A client is allowed if it
+// does not match any denied range, and either matches an allowed
+// range or there are none. IPv4 clients connecting over IPv6 are
+// matched as IPv4. An empty list returns nil, which allows all
+// clients.
+func ParseClientRules(rules []string) (*ClientRules, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	r := &ClientRules{}
+	for _, rule := range rules {
+		s, deny := strings.CutPrefix(strings.TrimSpace(rule), "!")
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client rule %q, expected an IP address or CIDR range, optionally prefixed with !", rule)
+		}
+		if deny {
+			r.deny = append(r.deny, prefix)
+		} else {
+			r.allow = append(r.allow, prefix)
+		}
+	}
+	return r, nil
+}
+
+// parsePrefix parses a CIDR range, or a single IP address as a range
+// containing only that address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Allows reports whether the client with the given address is
+// allowed. Clients without an IP address, e.g. on Unix domain
+// sockets, are only allowed if there are no allowed ranges.
+func (r *ClientRules) Allows(addr net.Addr) bool {
+	if r == nil {
+		return true
+	}
+	ip, ok := clientIP(addr)
+	if !ok {
+		return len(r.allow) == 0
+	}
+	for _, prefix := range r.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, prefix := range r.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of addr, if it has one.
+func clientIP(addr net.Addr) (netip.Addr, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, ok := netip.AddrFromSlice(a.IP)
+		return ip.Unmap(), ok
+	case *net.UDPAddr:
+		ip, ok := netip.AddrFromSlice(a.IP)
+		return ip.Unmap(), ok
+	case nil:
+		return netip.Addr{}, false
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
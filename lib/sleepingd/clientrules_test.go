@@ -0,0 +1,70 @@
+package sleepingd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ClientRules(t *testing.T) {
+	tcpAddr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+	tests := []struct {
+		Description string
+		Rules       []string
+		Allowed     []net.Addr
+		Denied      []net.Addr
+	}{
+		{
+			Description: "no rules allow everyone",
+			Rules:       nil,
+			Allowed:     []net.Addr{tcpAddr("203.0.113.1"), tcpAddr("::1"), &net.UnixAddr{Name: "@"}},
+		},
+		{
+			Description: "allowed ranges only",
+			Rules:       []string{"203.0.113.0/24", "10.8.0.0/16", "2001:db8::/32"},
+			Allowed: []net.Addr{
+				tcpAddr("203.0.113.7"),
+				tcpAddr("10.8.200.1"),
+				tcpAddr("::ffff:10.8.0.1"),
+				&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53},
+			},
+			Denied: []net.Addr{
+				tcpAddr("198.51.100.1"),
+				tcpAddr("10.9.0.1"),
+				&net.UnixAddr{Name: "@"},
+			},
+		},
+		{
+			Description: "denied ranges win",
+			Rules:       []string{"10.0.0.0/8", "!10.66.0.0/16", "!192.0.2.1"},
+			Allowed:     []net.Addr{tcpAddr("10.1.2.3")},
+			Denied:      []net.Addr{tcpAddr("10.66.1.1"), tcpAddr("192.0.2.1"), tcpAddr("127.0.0.1")},
+		},
+		{
+			Description: "denied ranges only",
+			Rules:       []string{"!198.51.100.0/24", "!::ffff:192.0.2.0/120"},
+			Allowed:     []net.Addr{tcpAddr("203.0.113.1"), tcpAddr("::1"), &net.UnixAddr{Name: "@"}},
+			Denied:      []net.Addr{tcpAddr("198.51.100.9"), tcpAddr("192.0.2.1")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			rules, err := ParseClientRules(test.Rules)
+			require.NoError(t, err)
+			for _, addr := range test.Allowed {
+				assert.True(t, rules.Allows(addr), "expected %s to be allowed", addr)
+			}
+			for _, addr := range test.Denied {
+				assert.False(t, rules.Allows(addr), "expected %s to be denied", addr)
+			}
+		})
+	}
+	for _, rule := range []string{"", "!", "10.0.0.0/33", "example.com", "10.0.0.0/8/8"} {
+		_, err := ParseClientRules([]string{rule})
+		assert.Error(t, err, "expected %q to be invalid", rule)
+	}
+}
@@ -0,0 +1,90 @@
+package sleepingd
+
+import (
+	"encoding/json"
+	"slices"
+
+	"github.com/riywo/loginshell"
+	"gopkg.in/validator.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// CommandLine is the command used to start an application. It can be
+// given either as a single string, which is run by a shell (shell
+// form), or as a list of arguments, which are executed directly
+// without a shell (exec form). Exactly one of Script and Args is set.
+type CommandLine struct {
+	// Script is the command string for shell form.
+	Script string
+	// Args is the executable and its arguments for exec form.
+	Args []string
+}
+
+func init() {
+	Must(validator.SetValidationFunc("command", func(v interface{}, param string) error {
+		cmd, ok := v.(CommandLine)
+		if !ok {
+			return validator.ErrUnsupported
+		}
+		if cmd.Script == "" && (len(cmd.Args) == 0 || cmd.Args[0] == "") {
+			return validator.ErrZeroValue
+		}
+		return nil
+	}))
+}
+
+// UnmarshalText parses a command from an environment variable. If
+// the value is a JSON array of strings, then it is exec form,
+// otherwise it is shell form, even if it starts with "[" (as in
+// "[ -f .env ] && . ./.env; exec app"), like in a Dockerfile.
+func (c *CommandLine) UnmarshalText(text []byte) error {
+	args := []string{}
+	if err := json.Unmarshal(text, &args); err == nil {
+		*c = CommandLine{Args: args}
+		return nil
+	}
+	*c = CommandLine{Script: string(text)}
+	return nil
+}
+
+// UnmarshalYAML parses a command from a configuration file. If the
+// value is a sequence of strings, then it is exec form, otherwise it
+// is shell form.
+func (c *CommandLine) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		args := []string{}
+		if err := value.Decode(&args); err != nil {
+			return err
+		}
+		*c = CommandLine{Args: args}
+		return nil
+	}
+	script := ""
+	if err := value.Decode(&script); err != nil {
+		return err
+	}
+	*c = CommandLine{Script: script}
+	return nil
+}
+
+// Equal reports whether two commands are the same.
+func (c CommandLine) Equal(other CommandLine) bool {
+	return c.Script == other.Script && slices.Equal(c.Args, other.Args)
+}
+
+// Argv returns the arguments to execute for the command. For shell
+// form, the command string is passed with -c to the given shell, or
+// to the current user's login shell if shell is empty.
+func (c CommandLine) Argv(shell string) ([]string, error) {
+	if c.Args != nil {
+		return c.Args, nil
+	}
+	if shell == "" {
+		var err error
+		shell, err = loginshell.Shell()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []string{shell, "-c", c.Script}, nil
+}
@@ -0,0 +1,46 @@
+package sleepingd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func Test_CommandLine_UnmarshalText(t *testing.T) {
+	cmd := CommandLine{}
+	require.NoError(t, cmd.UnmarshalText([]byte("node server.js")))
+	assert.Equal(t, CommandLine{Script: "node server.js"}, cmd)
+	require.NoError(t, cmd.UnmarshalText([]byte(`["node", "server.js", "--port", "8080"]`)))
+	assert.Equal(t, CommandLine{Args: []string{"node", "server.js", "--port", "8080"}}, cmd)
+	// Anything else is shell form, even if it looks a bit like
+	// JSON.
+	require.NoError(t, cmd.UnmarshalText([]byte("[ -f .env ] && . ./.env; exec app")))
+	assert.Equal(t, CommandLine{Script: "[ -f .env ] && . ./.env; exec app"}, cmd)
+	require.NoError(t, cmd.UnmarshalText([]byte(`["node", 5]`)))
+	assert.Equal(t, CommandLine{Script: `["node", 5]`}, cmd)
+}
+
+func Test_CommandLine_UnmarshalYAML(t *testing.T) {
+	var parsed struct {
+		Shell CommandLine `yaml:"shell"`
+		Exec  CommandLine `yaml:"exec"`
+	}
+	require.NoError(t, yaml.Unmarshal([]byte(`
+shell: node server.js
+exec: [node, server.js]
+`), &parsed))
+	assert.Equal(t, CommandLine{Script: "node server.js"}, parsed.Shell)
+	assert.Equal(t, CommandLine{Args: []string{"node", "server.js"}}, parsed.Exec)
+}
+
+func Test_CommandLine_Argv(t *testing.T) {
+	argv, err := CommandLine{Script: "echo $HOME"}.Argv("/bin/sh")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/bin/sh", "-c", "echo $HOME"}, argv)
+	// Exec form ignores the shell
+	argv, err = CommandLine{Args: []string{"echo", "$HOME"}}.Argv("/bin/sh")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"echo", "$HOME"}, argv)
+}
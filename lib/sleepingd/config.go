@@ -0,0 +1,492 @@
+package sleepingd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+	"gopkg.in/validator.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is prepended to the names given in the env struct tags
+// of Options and AppOptions to get the environment variables that
+// configure them.
+const EnvPrefix = "SLEEPING_BEAUTY_"
+
+// DefaultAppName is the name of the application that is configured
+// when neither a configuration file nor SLEEPING_BEAUTY_APPS lists
+// any applications.
+const DefaultAppName = "default"
+
+// appEnvPrefix returns the prefix for environment variables that
+// apply only to the named application, e.g. SLEEPING_BEAUTY_APP_WEB_
+// for an application named "web".
+func appEnvPrefix(name string) string {
+	return EnvPrefix + "APP_" + strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, name) + "_"
+}
+
+// appEnvironment returns the environment to parse AppOptions from
+// for the named application. Variables like SLEEPING_BEAUTY_COMMAND
+// apply to all applications, but can be overridden for a single
+// application using variables like SLEEPING_BEAUTY_APP_WEB_COMMAND.
+func appEnvironment(environ map[string]string, name string) map[string]string {
+	appEnviron := map[string]string{}
+	for key, value := range environ {
+		appEnviron[key] = value
+	}
+	prefix := appEnvPrefix(name)
+	for key, value := range environ {
+		if suffix, ok := strings.CutPrefix(key, prefix); ok {
+			appEnviron[EnvPrefix+suffix] = value
+		}
+	}
+	return appEnviron
+}
+
+// setDefaults fills in default values for any options that were not
+// provided by either the configuration file or the environment.
+func (opts *Options) setDefaults() {
+	if opts.MetricsHost == "" {
+		opts.MetricsHost = "0.0.0.0"
+	}
+	if opts.DrainTimeoutSeconds == 0 {
+		opts.DrainTimeoutSeconds = 20
+	}
+	for _, app := range opts.Apps {
+		if app.ListenHost == "" {
+			app.ListenHost = "0.0.0.0"
+		}
+		if app.Protocol == "" {
+			app.Protocol = "tcp"
+		}
+		if app.CommandHost == "" {
+			app.CommandHost = "127.0.0.1"
+		}
+		if app.UDPSessionTimeoutSeconds == 0 {
+			app.UDPSessionTimeoutSeconds = int(DefaultUDPSessionTimeout / time.Second)
+		}
+		if app.DialAttempts == 0 {
+			app.DialAttempts = 5
+		}
+		if app.DialBackoffMilliseconds == 0 {
+			app.DialBackoffMilliseconds = 100
+		}
+		if app.DialTimeoutSeconds == 0 {
+			app.DialTimeoutSeconds = 10
+		}
+		if app.Mode == "" {
+			app.Mode = "raw"
+		}
+		if app.HTTPWakeResponse == "" {
+			app.HTTPWakeResponse = "hold"
+		}
+		if app.HTTPWakeTimeoutSeconds == 0 {
+			app.HTTPWakeTimeoutSeconds = 30
+		}
+		if app.HTTPRetryAfterSeconds == 0 {
+			app.HTTPRetryAfterSeconds = 5
+		}
+		if app.TLSMinVersion == "" {
+			app.TLSMinVersion = "1.2"
+		}
+		if app.HealthCheckStatus == 0 {
+			app.HealthCheckStatus = 200
+		}
+		if app.HealthCheckBody == "" {
+			app.HealthCheckBody = "ok"
+		}
+	}
+}
+
+// LoadConfig reads Options from the YAML configuration file at path
+// (if path is non-empty) and then from environ, which maps
+// environment variable names to values. Environment variables take
+// precedence over keys in the configuration file. The list of
+// applications is taken from SLEEPING_BEAUTY_APPS if set, otherwise
+// from the configuration file, otherwise a single application named
+// DefaultAppName is configured. Validation errors refer to the line
+// of the configuration file where the offending key was set, when
+// possible.
+func LoadConfig(path string, environ map[string]string) (*Options, error) {
+	opts := &Options{}
+	var root *yaml.Node
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		root = &yaml.Node{}
+		if err := yaml.Unmarshal(data, root); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(opts); err != nil && !errors.Is(err, io.EOF) {
+			if typeErr, ok := err.(*yaml.TypeError); ok {
+				return nil, fmt.Errorf("%s: %s", path, strings.Join(typeErr.Errors, "; "))
+			}
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		opts.fileApps = opts.Apps
+	}
+	if err := env.ParseWithOptions(opts, env.Options{
+		Environment: environ,
+		Prefix:      EnvPrefix,
+	}); err != nil {
+		return nil, err
+	}
+	if names, ok := environ[EnvPrefix+"APPS"]; ok {
+		apps := []*AppOptions{}
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				return nil, fmt.Errorf("invalid application name in %sAPPS: %q", EnvPrefix, names)
+			}
+			app := &AppOptions{Name: name}
+			for _, fileApp := range opts.Apps {
+				if fileApp != nil && fileApp.Name == name {
+					app = fileApp
+				}
+			}
+			apps = append(apps, app)
+		}
+		opts.Apps = apps
+	}
+	if len(opts.Apps) == 0 {
+		opts.Apps = []*AppOptions{{Name: DefaultAppName}}
+	}
+	for i, app := range opts.Apps {
+		if app == nil {
+			return nil, fmt.Errorf("%s: apps[%d] is empty", path, i)
+		}
+		if err := env.ParseWithOptions(app, env.Options{
+			Environment: appEnvironment(environ, app.Name),
+			Prefix:      EnvPrefix,
+		}); err != nil {
+			return nil, fmt.Errorf("application %s: %w", app.Name, err)
+		}
+	}
+	opts.setDefaults()
+	if err := opts.validate(path, root); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// validate checks opts against the validate struct tags, and returns
+// an error describing every problem found. Each problem is reported
+// using the name of the key in the configuration file and the
+// corresponding environment variable, and if the key was set in the
+// configuration file then its line number is given as well.
+func (opts *Options) validate(path string, root *yaml.Node) error {
+	problems := []string{}
+	names := map[string]bool{}
+	for i, app := range opts.Apps {
+		if app.Name != "" && names[app.Name] {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Name", i), "duplicate application name "+app.Name))
+		}
+		names[app.Name] = true
+		if app.TimeoutSeconds == 0 && app.Mode != "handoff" {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].TimeoutSeconds", i), "zero value"))
+		}
+		if app.CommandPort == 0 && app.CommandSocket == "" && app.Mode != "handoff" {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].CommandPort", i), "zero value, and command_socket is not set"))
+		}
+		if app.ListenPort == 0 && app.ListenSocket == "" && app.ListenFDName == "" {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].ListenPort", i), "zero value, and neither listen_socket nor listen_fd_name is set"))
+		}
+		if app.ListenSocket != "" && app.ListenFDName != "" {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].ListenFDName", i), "cannot be used with listen_socket"))
+		}
+		if app.Protocol == "udp" && (app.CommandSocket != "" || app.ListenSocket != "") {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Protocol", i), "udp cannot be used with Unix domain sockets"))
+		}
+		if app.Protocol == "udp" && app.Mode == "http" {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Mode", i), "http cannot be used with udp"))
+		}
+		if app.Protocol == "udp" && (app.SendProxyProtocol != "" || app.AcceptProxyProtocol) {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Protocol", i), "udp cannot be used with the PROXY protocol"))
+		}
+		if app.Protocol == "udp" && !isLoopbackHost(app.CommandHost) {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].CommandHost", i), "must be a loopback address with udp, since readiness cannot be checked otherwise"))
+		}
+		if app.WakeOnConnect && (app.Protocol == "udp" || app.Mode != "raw" || app.routed()) {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].WakeOnConnect", i), "can only be used in raw mode with tcp, and without hostnames or default_route"))
+		}
+		if app.Protocol == "udp" && app.HalfClose {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].HalfClose", i), "cannot be used with udp"))
+		}
+		if app.Protocol == "udp" && (app.ConnectionIdleTimeoutSeconds != 0 || app.ConnectionWriteTimeoutSeconds != 0 || app.ConnectionMaxAgeSeconds != 0 || app.TCPKeepAliveSeconds != 0) {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Protocol", i), "udp cannot be used with connection timeouts or TCP keepalive"))
+		}
+		if (app.TLSCertFile == "") != (app.TLSKeyFile == "") {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].TLSCertFile", i), "tls_cert_file and tls_key_file must be set together"))
+		}
+		if app.Protocol == "udp" && app.TLSCertFile != "" {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Protocol", i), "udp cannot be used with TLS"))
+		}
+		if app.Protocol == "udp" && app.routed() {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Protocol", i), "udp cannot be used with hostnames or default_route"))
+		}
+		if app.Mode == "handoff" {
+			if app.Protocol == "udp" {
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Mode", i), "handoff cannot be used with udp"))
+			}
+			if app.Command.Args == nil {
+				// A shell might fork the command rather
+				// than exec it, and then LISTEN_PID would
+				// not match.
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Command", i), "must be in exec form in handoff mode"))
+			}
+			if app.TLSCertFile != "" || app.SendProxyProtocol != "" || app.AcceptProxyProtocol {
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Mode", i), "handoff cannot be used with TLS or the PROXY protocol"))
+			}
+			if app.routed() {
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Mode", i), "handoff cannot be used with hostnames or default_route"))
+			}
+			if len(app.ExtraPorts) > 0 {
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Mode", i), "handoff cannot be used with extra_ports"))
+			}
+			if app.HalfClose {
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Mode", i), "handoff cannot be used with half_close"))
+			}
+			if len(app.ConnectFrom) > 0 || len(app.WakeFrom) > 0 || len(app.KeepAwakeFrom) > 0 {
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Mode", i), "handoff cannot be used with connect_from, wake_from, or keep_awake_from"))
+			}
+		}
+		listenPorts := map[int]bool{}
+		if app.ListenSocket == "" && app.ListenFDName == "" {
+			listenPorts[app.ListenPort] = true
+		}
+		for j, m := range app.ExtraPorts {
+			if m.WakeOnConnect && app.Protocol == "udp" {
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].ExtraPorts[%d]", i, j), "wake_on_connect cannot be used with udp"))
+			}
+			if m.ListenPort <= 0 || m.CommandPort <= 0 {
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].ExtraPorts[%d]", i, j), "listen_port and command_port must be positive"))
+			} else if listenPorts[m.ListenPort] {
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].ExtraPorts[%d]", i, j), fmt.Sprintf("listen port %d is already used", m.ListenPort)))
+			}
+			listenPorts[m.ListenPort] = true
+			for _, rules := range []struct {
+				key   string
+				rules []string
+			}{
+				{"connect_from", m.ConnectFrom},
+				{"wake_from", m.WakeFrom},
+				{"keep_awake_from", m.KeepAwakeFrom},
+			} {
+				if _, err := ParseClientRules(rules.rules); err != nil {
+					problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].ExtraPorts[%d]", i, j), fmt.Sprintf("%s: %s", rules.key, err)))
+				}
+			}
+		}
+		if len(app.HealthChecks) > 0 && app.Mode != "http" {
+			problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].HealthChecks", i), "can only be used in http mode"))
+		}
+		for _, hc := range app.HealthChecks {
+			if _, err := ParseHealthCheck(hc); err != nil {
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].HealthChecks", i), err.Error()))
+			}
+		}
+		for _, rules := range []struct {
+			field string
+			rules []string
+		}{
+			{"ConnectFrom", app.ConnectFrom},
+			{"WakeFrom", app.WakeFrom},
+			{"KeepAwakeFrom", app.KeepAwakeFrom},
+		} {
+			if _, err := ParseClientRules(rules.rules); err != nil {
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].%s", i, rules.field), err.Error()))
+			}
+		}
+	}
+	problems = append(problems, opts.validateRoutes(path, root)...)
+	if err := validator.Validate(opts); err != nil {
+		errs, ok := err.(validator.ErrorMap)
+		if !ok {
+			return err
+		}
+		fields := []string{}
+		for field := range errs {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			problems = append(problems, opts.describeField(path, root, field, errs[field].Error()))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// validateRoutes checks that applications which share a listen
+// address can be told apart by hostname, see ListenRouted, and
+// returns a description of every problem found.
+func (opts *Options) validateRoutes(path string, root *yaml.Node) []string {
+	problems := []string{}
+	first := map[string]int{}
+	defaults := map[string]string{}
+	hostnames := map[string]string{}
+	for i, app := range opts.Apps {
+		if app.ListenPort == 0 && app.ListenSocket == "" && app.ListenFDName == "" {
+			continue
+		}
+		addr := describeAddr(app.listenAddr())
+		j, shared := first[addr]
+		if !shared {
+			first[addr] = i
+		} else {
+			other := opts.Apps[j]
+			if !app.routed() || !other.routed() {
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Hostnames", i), fmt.Sprintf("listen address %s is shared with application %s, so both must set hostnames or default_route", addr, other.Name)))
+			}
+			if app.AcceptProxyProtocol != other.AcceptProxyProtocol {
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].AcceptProxyProtocol", i), fmt.Sprintf("must be the same as for application %s, which shares listen address %s", other.Name, addr)))
+			}
+		}
+		if app.DefaultRoute {
+			if other, ok := defaults[addr]; ok {
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].DefaultRoute", i), fmt.Sprintf("application %s is already the default route for %s", other, addr)))
+			}
+			defaults[addr] = app.Name
+		}
+		for _, hostname := range app.Hostnames {
+			key := addr + " " + normalizeHostname(hostname)
+			if other, ok := hostnames[key]; ok {
+				problems = append(problems, opts.describeField(path, root, fmt.Sprintf("Apps[%d].Hostnames", i), fmt.Sprintf("hostname %s is already used by application %s", hostname, other)))
+			}
+			hostnames[key] = app.Name
+		}
+	}
+	return problems
+}
+
+var fieldPathPart = regexp.MustCompile(`^(\w+)(?:\[(\d+)\])?$`)
+
+// describeField formats a problem with the struct field identified by
+// field, which is a path in the format used by validator.ErrorMap,
+// e.g. "Apps[0].Command".
+func (opts *Options) describeField(path string, root *yaml.Node, field string, problem string) string {
+	keys := []string{}
+	envKey := EnvPrefix
+	inFile := true
+	typ := reflect.TypeOf(*opts)
+	for _, part := range strings.Split(field, ".") {
+		match := fieldPathPart.FindStringSubmatch(part)
+		if match == nil {
+			break
+		}
+		structField, ok := typ.FieldByName(match[1])
+		if !ok {
+			break
+		}
+		if name := strings.Split(structField.Tag.Get("yaml"), ",")[0]; name != "" {
+			keys = append(keys, name)
+		}
+		if name := strings.Split(structField.Tag.Get("env"), ",")[0]; name != "" && name != "-" {
+			envKey += name
+		}
+		typ = structField.Type
+		if match[2] != "" {
+			idx, _ := strconv.Atoi(match[2])
+			if match[1] == "Apps" && idx < len(opts.Apps) {
+				if opts.Apps[idx].Name != DefaultAppName {
+					envKey = appEnvPrefix(opts.Apps[idx].Name)
+				}
+				// Refer to the application where it is
+				// in the configuration file, if it is.
+				if fileIdx := opts.fileIndex(idx); fileIdx >= 0 {
+					idx = fileIdx
+				} else {
+					inFile = false
+				}
+			}
+			keys = append(keys, strconv.Itoa(idx))
+			typ = typ.Elem()
+		}
+		for typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+	}
+	desc := fmt.Sprintf("%s: %s", strings.Join(keys, "."), problem)
+	if !strings.HasSuffix(envKey, "_") {
+		desc = fmt.Sprintf("%s (%s): %s", strings.Join(keys, "."), envKey, problem)
+	}
+	if root != nil && inFile {
+		if line := findLine(root, keys); line > 0 {
+			desc = fmt.Sprintf("%s:%d: %s", path, line, desc)
+		}
+	}
+	return desc
+}
+
+// fileIndex returns the index in the configuration file of
+// opts.Apps[idx], or -1 if it is not in the configuration file.
+func (opts *Options) fileIndex(idx int) int {
+	for i, app := range opts.fileApps {
+		if app == opts.Apps[idx] {
+			return i
+		}
+	}
+	return -1
+}
+
+// findLine returns the line number of the YAML node found by
+// following keys (mapping keys or sequence indices) from root. If
+// the full path does not exist, then the line number of the deepest
+// node that does exist is returned instead, so that errors about
+// missing keys point at the mapping they are missing from.
+func findLine(root *yaml.Node, keys []string) int {
+	node := root
+	if node.Kind == yaml.DocumentNode {
+		if len(node.Content) == 0 {
+			return 0
+		}
+		node = node.Content[0]
+	}
+	line := node.Line
+	for _, key := range keys {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					line = node.Content[i].Line
+					next = node.Content[i+1]
+				}
+			}
+		case yaml.SequenceNode:
+			if idx, err := strconv.Atoi(key); err == nil && idx < len(node.Content) {
+				next = node.Content[idx]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return line
+}
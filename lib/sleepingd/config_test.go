@@ -0,0 +1,458 @@
+package sleepingd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "sleepingd.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o644))
+	return path
+}
+
+func Test_LoadConfig_Env(t *testing.T) {
+	opts, err := LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_COMMAND":         "node server.js",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS": "60",
+		"SLEEPING_BEAUTY_COMMAND_PORT":    "8080",
+		"SLEEPING_BEAUTY_LISTEN_PORT":     "80",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &Options{
+		Apps: []*AppOptions{{
+			Name:           DefaultAppName,
+			Command:        CommandLine{Script: "node server.js"},
+			TimeoutSeconds: 60,
+			CommandPort:    8080,
+			ListenPort:     80,
+			ListenHost:     "0.0.0.0",
+			CommandHost:    "127.0.0.1",
+			Protocol:       "tcp",
+
+			UDPSessionTimeoutSeconds: 60,
+			DialAttempts:             5,
+			DialBackoffMilliseconds:  100,
+			DialTimeoutSeconds:       10,
+			Mode:                     "raw",
+			HTTPWakeResponse:         "hold",
+			HTTPWakeTimeoutSeconds:   30,
+			HTTPRetryAfterSeconds:    5,
+			TLSMinVersion:            "1.2",
+			HealthCheckStatus:        200,
+			HealthCheckBody:          "ok",
+		}},
+		MetricsHost:         "0.0.0.0",
+		DrainTimeoutSeconds: 20,
+	}, opts)
+}
+
+func Test_LoadConfig_EnvMultipleApps(t *testing.T) {
+	opts, err := LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_APPS":                            "web, admin-panel",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS":                 "60",
+		"SLEEPING_BEAUTY_APP_WEB_COMMAND":                 "node server.js",
+		"SLEEPING_BEAUTY_APP_WEB_COMMAND_PORT":            "8080",
+		"SLEEPING_BEAUTY_APP_WEB_LISTEN_PORT":             "80",
+		"SLEEPING_BEAUTY_APP_ADMIN_PANEL_COMMAND":         "node admin.js",
+		"SLEEPING_BEAUTY_APP_ADMIN_PANEL_TIMEOUT_SECONDS": "10",
+		"SLEEPING_BEAUTY_APP_ADMIN_PANEL_COMMAND_PORT":    "8081",
+		"SLEEPING_BEAUTY_APP_ADMIN_PANEL_LISTEN_PORT":     "8000",
+	})
+	require.NoError(t, err)
+	require.Len(t, opts.Apps, 2)
+	assert.Equal(t, "web", opts.Apps[0].Name)
+	assert.Equal(t, CommandLine{Script: "node server.js"}, opts.Apps[0].Command)
+	assert.Equal(t, 60, opts.Apps[0].TimeoutSeconds)
+	assert.Equal(t, "admin-panel", opts.Apps[1].Name)
+	assert.Equal(t, CommandLine{Script: "node admin.js"}, opts.Apps[1].Command)
+	assert.Equal(t, 10, opts.Apps[1].TimeoutSeconds)
+	assert.Equal(t, 8000, opts.Apps[1].ListenPort)
+}
+
+func Test_LoadConfig_File(t *testing.T) {
+	path := writeConfigFile(t, `
+metrics_port: 9090
+apps:
+  - name: web
+    command: node server.js
+    timeout_seconds: 60
+    command_port: 8080
+    listen_port: 80
+  - name: admin
+    command: node admin.js
+    timeout_seconds: 60
+    command_port: 8081
+    listen_port: 8000
+    listen_host: 127.0.0.1
+`)
+	opts, err := LoadConfig(path, map[string]string{
+		"SLEEPING_BEAUTY_APP_ADMIN_TIMEOUT_SECONDS": "10",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 9090, opts.MetricsPort)
+	require.Len(t, opts.Apps, 2)
+	assert.Equal(t, 60, opts.Apps[0].TimeoutSeconds)
+	assert.Equal(t, "0.0.0.0", opts.Apps[0].ListenHost)
+	// Environment variable overrides the file
+	assert.Equal(t, 10, opts.Apps[1].TimeoutSeconds)
+	assert.Equal(t, "127.0.0.1", opts.Apps[1].ListenHost)
+}
+
+func Test_LoadConfig_FileUnknownKey(t *testing.T) {
+	path := writeConfigFile(t, `apps:
+  - name: web
+    command: node server.js
+    timeout: 60
+`)
+	_, err := LoadConfig(path, map[string]string{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 4: field timeout not found")
+}
+
+func Test_LoadConfig_FileInvalid(t *testing.T) {
+	path := writeConfigFile(t, `apps:
+  - name: web
+    command: node server.js
+    timeout_seconds: -5
+    command_port: 8080
+    listen_port: 80
+`)
+	_, err := LoadConfig(path, map[string]string{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), path+":4: apps.0.timeout_seconds (SLEEPING_BEAUTY_APP_WEB_TIMEOUT_SECONDS): less than min")
+}
+
+func Test_LoadConfig_FileInvalidReordered(t *testing.T) {
+	path := writeConfigFile(t, `apps:
+  - name: web
+    command: node server.js
+    timeout_seconds: 60
+    command_port: 8080
+    listen_port: 80
+  - name: admin
+    command: node admin.js
+    timeout_seconds: -5
+    command_port: 8081
+    listen_port: 8000
+`)
+	_, err := LoadConfig(path, map[string]string{
+		"SLEEPING_BEAUTY_APPS": "admin,extra",
+	})
+	require.Error(t, err)
+	// The error refers to admin where it is in the file, not
+	// where it is in SLEEPING_BEAUTY_APPS
+	assert.Contains(t, err.Error(), path+":9: apps.1.timeout_seconds (SLEEPING_BEAUTY_APP_ADMIN_TIMEOUT_SECONDS): less than min")
+	// Applications that are not in the file have no line
+	assert.Contains(t, err.Error(), "\n  apps.1.command_port (SLEEPING_BEAUTY_APP_EXTRA_COMMAND_PORT): zero value")
+}
+
+func Test_LoadConfig_Protocol(t *testing.T) {
+	opts, err := LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_COMMAND":         "./resolver",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS": "60",
+		"SLEEPING_BEAUTY_COMMAND_PORT":    "5353",
+		"SLEEPING_BEAUTY_LISTEN_PORT":     "53",
+		"SLEEPING_BEAUTY_PROTOCOL":        "udp",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "udp", opts.Apps[0].Protocol)
+	_, err = LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_COMMAND":         "./resolver",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS": "60",
+		"SLEEPING_BEAUTY_COMMAND_PORT":    "5353",
+		"SLEEPING_BEAUTY_LISTEN_PORT":     "53",
+		"SLEEPING_BEAUTY_PROTOCOL":        "sctp",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "protocol (SLEEPING_BEAUTY_PROTOCOL): regular expression mismatch")
+	_, err = LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_COMMAND":         "./resolver",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS": "60",
+		"SLEEPING_BEAUTY_COMMAND_PORT":    "5353",
+		"SLEEPING_BEAUTY_COMMAND_HOST":    "resolver.internal",
+		"SLEEPING_BEAUTY_LISTEN_PORT":     "53",
+		"SLEEPING_BEAUTY_PROTOCOL":        "udp",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "command_host (SLEEPING_BEAUTY_COMMAND_HOST): must be a loopback address with udp")
+}
+
+func Test_LoadConfig_Sockets(t *testing.T) {
+	opts, err := LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_COMMAND":            "gunicorn --bind unix:/run/app.sock app:app",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS":    "60",
+		"SLEEPING_BEAUTY_COMMAND_SOCKET":     "/run/app.sock",
+		"SLEEPING_BEAUTY_LISTEN_SOCKET":      "/run/sleepingd-app.sock",
+		"SLEEPING_BEAUTY_LISTEN_SOCKET_MODE": "0660",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "/run/app.sock", opts.Apps[0].CommandSocket)
+	assert.Equal(t, "/run/sleepingd-app.sock", opts.Apps[0].ListenSocket)
+	_, err = LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_COMMAND":            "./resolver",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS":    "60",
+		"SLEEPING_BEAUTY_PROTOCOL":           "udp",
+		"SLEEPING_BEAUTY_COMMAND_SOCKET":     "/run/app.sock",
+		"SLEEPING_BEAUTY_LISTEN_SOCKET_MODE": "rw-rw----",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "listen_port (SLEEPING_BEAUTY_LISTEN_PORT): zero value, and neither listen_socket nor listen_fd_name is set")
+	assert.Contains(t, err.Error(), "protocol (SLEEPING_BEAUTY_PROTOCOL): udp cannot be used with Unix domain sockets")
+	assert.Contains(t, err.Error(), "listen_socket_mode (SLEEPING_BEAUTY_LISTEN_SOCKET_MODE): regular expression mismatch")
+}
+
+func Test_LoadConfig_HealthChecks(t *testing.T) {
+	_, err := LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_COMMAND":         "node server.js",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS": "60",
+		"SLEEPING_BEAUTY_COMMAND_PORT":    "8080",
+		"SLEEPING_BEAUTY_LISTEN_PORT":     "80",
+		"SLEEPING_BEAUTY_HEALTH_CHECKS":   "/healthz,GET healthz",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "health_checks (SLEEPING_BEAUTY_HEALTH_CHECKS): can only be used in http mode")
+	assert.Contains(t, err.Error(), `health_checks (SLEEPING_BEAUTY_HEALTH_CHECKS): invalid health check "GET healthz"`)
+}
+
+func Test_LoadConfig_ClientRules(t *testing.T) {
+	opts, err := LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_COMMAND":         "node server.js",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS": "60",
+		"SLEEPING_BEAUTY_COMMAND_PORT":    "8080",
+		"SLEEPING_BEAUTY_LISTEN_PORT":     "80",
+		"SLEEPING_BEAUTY_WAKE_FROM":       "203.0.113.0/24,10.8.0.0/16,!10.8.66.6",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"203.0.113.0/24", "10.8.0.0/16", "!10.8.66.6"}, opts.Apps[0].WakeFrom)
+	_, err = LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_COMMAND":         "node server.js",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS": "60",
+		"SLEEPING_BEAUTY_COMMAND_PORT":    "8080",
+		"SLEEPING_BEAUTY_LISTEN_PORT":     "80",
+		"SLEEPING_BEAUTY_MODE":            "handoff",
+		"SLEEPING_BEAUTY_CONNECT_FROM":    "10.0.0.0/8",
+		"SLEEPING_BEAUTY_KEEP_AWAKE_FROM": "office",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "mode (SLEEPING_BEAUTY_MODE): handoff cannot be used with connect_from, wake_from, or keep_awake_from")
+	assert.Contains(t, err.Error(), `keep_awake_from (SLEEPING_BEAUTY_KEEP_AWAKE_FROM): invalid client rule "office"`)
+}
+
+func Test_LoadConfig_HandoffShellForm(t *testing.T) {
+	_, err := LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_COMMAND":     "node server.js",
+		"SLEEPING_BEAUTY_LISTEN_PORT": "80",
+		"SLEEPING_BEAUTY_MODE":        "handoff",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "command (SLEEPING_BEAUTY_COMMAND): must be in exec form in handoff mode")
+	opts, err := LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_COMMAND":     `["node", "server.js"]`,
+		"SLEEPING_BEAUTY_LISTEN_PORT": "80",
+		"SLEEPING_BEAUTY_MODE":        "handoff",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"node", "server.js"}, opts.Apps[0].Command.Args)
+}
+
+func Test_LoadConfig_TLS(t *testing.T) {
+	_, err := LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_COMMAND":         "node server.js",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS": "60",
+		"SLEEPING_BEAUTY_COMMAND_PORT":    "8080",
+		"SLEEPING_BEAUTY_LISTEN_PORT":     "80",
+		"SLEEPING_BEAUTY_TLS_CERT_FILE":   "/etc/ssl/cert.pem",
+		"SLEEPING_BEAUTY_TLS_MIN_VERSION": "1.4",
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "tls_cert_file (SLEEPING_BEAUTY_TLS_CERT_FILE): tls_cert_file and tls_key_file must be set together")
+	assert.Contains(t, err.Error(), "tls_min_version (SLEEPING_BEAUTY_TLS_MIN_VERSION): regular expression mismatch")
+}
+
+func Test_LoadConfig_Routes(t *testing.T) {
+	path := writeConfigFile(t, `apps:
+  - name: web
+    command: node server.js
+    timeout_seconds: 60
+    command_port: 8080
+    listen_port: 443
+    hostnames: [www.example.com, example.com]
+    default_route: true
+  - name: blog
+    command: hugo server
+    timeout_seconds: 60
+    command_port: 8081
+    listen_port: 443
+    hostnames: [blog.example.com, Example.com]
+    default_route: true
+  - name: api
+    command: ./api
+    timeout_seconds: 60
+    command_port: 8082
+    listen_port: 443
+`)
+	_, err := LoadConfig(path, map[string]string{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), path+":14: apps.1.hostnames (SLEEPING_BEAUTY_APP_BLOG_HOSTNAMES): hostname Example.com is already used by application web")
+	assert.Contains(t, err.Error(), path+":15: apps.1.default_route (SLEEPING_BEAUTY_APP_BLOG_DEFAULT_ROUTE): application web is already the default route for 0.0.0.0:443")
+	assert.Contains(t, err.Error(), path+":16: apps.2.hostnames (SLEEPING_BEAUTY_APP_API_HOSTNAMES): listen address 0.0.0.0:443 is shared with application web, so both must set hostnames or default_route")
+	path = writeConfigFile(t, `apps:
+  - name: web
+    command: node server.js
+    timeout_seconds: 60
+    command_port: 8080
+    listen_port: 443
+    hostnames: [www.example.com]
+  - name: blog
+    command: hugo server
+    timeout_seconds: 60
+    command_port: 8081
+    listen_port: 443
+    default_route: true
+`)
+	opts, err := LoadConfig(path, map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"www.example.com"}, opts.Apps[0].Hostnames)
+	assert.True(t, opts.Apps[1].DefaultRoute)
+}
+
+func Test_LoadConfig_ExtraPorts(t *testing.T) {
+	opts, err := LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_COMMAND":         "node server.js",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS": "60",
+		"SLEEPING_BEAUTY_COMMAND_PORT":    "8080",
+		"SLEEPING_BEAUTY_LISTEN_PORT":     "80",
+		"SLEEPING_BEAUTY_EXTRA_PORTS":     "9090:9091,9000:9001:optional,2525:2526:optional:wake_on_connect",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []PortMapping{
+		{ListenPort: 9090, CommandPort: 9091},
+		{ListenPort: 9000, CommandPort: 9001, Optional: true},
+		{ListenPort: 2525, CommandPort: 2526, Optional: true, WakeOnConnect: true},
+	}, opts.Apps[0].ExtraPorts)
+	_, err = LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_COMMAND":         "node server.js",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS": "60",
+		"SLEEPING_BEAUTY_COMMAND_PORT":    "8080",
+		"SLEEPING_BEAUTY_LISTEN_PORT":     "80",
+		"SLEEPING_BEAUTY_EXTRA_PORTS":     "9090",
+	})
+	assert.ErrorContains(t, err, `invalid port mapping "9090"`)
+	path := writeConfigFile(t, `apps:
+  - name: web
+    command: node server.js
+    timeout_seconds: 60
+    command_port: 8080
+    listen_port: 80
+    extra_ports:
+      - "9090:9091"
+      - listen_port: 9000
+        command_port: 9001
+        optional: true
+      - listen_port: 80
+        command_port: 8081
+      - listen_port: 9443
+`)
+	_, err = LoadConfig(path, map[string]string{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), path+":12: apps.0.extra_ports.2 (SLEEPING_BEAUTY_APP_WEB_EXTRA_PORTS): listen port 80 is already used")
+	assert.Contains(t, err.Error(), path+":14: apps.0.extra_ports.3 (SLEEPING_BEAUTY_APP_WEB_EXTRA_PORTS): listen_port and command_port must be positive")
+	assert.NotContains(t, err.Error(), "extra_ports.0")
+	path = writeConfigFile(t, `apps:
+  - name: web
+    command: node server.js
+    timeout_seconds: 60
+    command_port: 8080
+    listen_port: 80
+    extra_ports:
+      - listen_port: 9000
+        comand_port: 9001
+`)
+	_, err = LoadConfig(path, map[string]string{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 9: field comand_port not found in type sleepingd.PortMapping")
+	assert.NotContains(t, err.Error(), "extra_ports.1")
+}
+
+func Test_LoadConfig_ExtraPortsClientRules(t *testing.T) {
+	path := writeConfigFile(t, `apps:
+  - name: web
+    command: node server.js
+    timeout_seconds: 60
+    command_port: 8080
+    listen_port: 80
+    wake_from: [10.8.0.0/16]
+    extra_ports:
+      - "9090:9091"
+      - listen_port: 9000
+        command_port: 9001
+        connect_from: [10.8.0.0/16]
+      - listen_port: 9443
+        command_port: 9444
+        wake_from: []
+`)
+	opts, err := LoadConfig(path, map[string]string{})
+	require.NoError(t, err)
+	ports := opts.Apps[0].ExtraPorts
+	assert.Nil(t, ports[0].ConnectFrom)
+	assert.Equal(t, []string{"10.8.0.0/16"}, ports[1].ConnectFrom)
+	assert.Nil(t, ports[1].WakeFrom)
+	assert.NotNil(t, ports[2].WakeFrom)
+	assert.Empty(t, ports[2].WakeFrom)
+	// Overriding with no rules is a change, since it allows
+	// everyone rather than inheriting the rules of the app.
+	assert.False(t, ports[2].equal(PortMapping{ListenPort: 9443, CommandPort: 9444}))
+	path = writeConfigFile(t, `apps:
+  - name: web
+    command: node server.js
+    timeout_seconds: 60
+    command_port: 8080
+    listen_port: 80
+    extra_ports:
+      - listen_port: 9000
+        command_port: 9001
+        keep_awake_from: [office]
+`)
+	_, err = LoadConfig(path, map[string]string{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), path+`:8: apps.0.extra_ports.0 (SLEEPING_BEAUTY_APP_WEB_EXTRA_PORTS): keep_awake_from: invalid client rule "office"`)
+}
+
+func Test_LoadConfig_FileMissingKey(t *testing.T) {
+	path := writeConfigFile(t, `apps:
+  - name: web
+    timeout_seconds: 60
+    command_port: 8080
+    listen_port: 80
+  - name: web
+    command: node server.js
+    timeout_seconds: 60
+    command_port: 8081
+    listen_port: 81
+`)
+	_, err := LoadConfig(path, map[string]string{})
+	require.Error(t, err)
+	// Missing key is reported at the start of the mapping it
+	// is missing from
+	assert.Contains(t, err.Error(), path+":2: apps.0.command (SLEEPING_BEAUTY_APP_WEB_COMMAND): zero value")
+	assert.Contains(t, err.Error(), path+":6: apps.1.name: duplicate application name web")
+}
+
+func Test_LoadConfig_EnvMap(t *testing.T) {
+	opts, err := LoadConfig("", map[string]string{
+		"SLEEPING_BEAUTY_COMMAND":         "node server.js",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS": "60",
+		"SLEEPING_BEAUTY_COMMAND_PORT":    "8080",
+		"SLEEPING_BEAUTY_LISTEN_PORT":     "80",
+		"SLEEPING_BEAUTY_ENV":             "NODE_ENV=production,PORT=8080",
+		"SLEEPING_BEAUTY_UNSET_ENV":       "SLEEPING_BEAUTY_*",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"NODE_ENV": "production", "PORT": "8080"}, opts.Apps[0].Env)
+	assert.Equal(t, []string{"SLEEPING_BEAUTY_*"}, opts.Apps[0].UnsetEnv)
+}
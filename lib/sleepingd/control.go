@@ -0,0 +1,109 @@
+package sleepingd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ControlRequest is sent by a client to the control socket, see
+// NewControlServer. Command is one of "status", "wake", "sleep",
+// "pause", or "resume". App is the name of the application to act
+// on. It may be omitted if only one application is configured, or
+// for the "status" command to report on all applications.
+type ControlRequest struct {
+	Command string `json:"command"`
+	App     string `json:"app,omitempty"`
+}
+
+// ControlResponse is sent back to the client in reply to a
+// ControlRequest. If the request failed, then Error is set.
+// Otherwise, Apps reports the status of the applications that were
+// acted on.
+type ControlResponse struct {
+	Error string       `json:"error,omitempty"`
+	Apps  []*AppStatus `json:"apps,omitempty"`
+}
+
+// ControlServer is returned by NewControlServer and can be used to
+// stop the server by calling Close.
+type ControlServer struct {
+	listener net.Listener
+}
+
+// NewControlServer listens on a Unix domain socket at the given
+// path, and calls handler for each ControlRequest that is received,
+// sending back the ControlResponse that is returned. Requests and
+// responses are encoded as JSON, one per line. If a stale socket
+// file exists at the path (i.e., one that nothing is listening on),
+// then it is removed first. The socket is only accessible by the
+// current user.
+func NewControlServer(path string, handler func(*ControlRequest) *ControlResponse) (*ControlServer, error) {
+	l, err := listenUnix(path, 0o600, "")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				continue
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				scanner := bufio.NewScanner(c)
+				encoder := json.NewEncoder(c)
+				for scanner.Scan() {
+					req := &ControlRequest{}
+					res := &ControlResponse{}
+					if err := json.Unmarshal(scanner.Bytes(), req); err != nil {
+						res.Error = fmt.Sprintf("malformed request: %s", err.Error())
+					} else {
+						res = handler(req)
+					}
+					if err := encoder.Encode(res); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return &ControlServer{
+		listener: l,
+	}, nil
+}
+
+// Close stops the server and removes the socket file.
+func (cs *ControlServer) Close() error {
+	return cs.listener.Close()
+}
+
+// SendControlRequest connects to the control socket at the given
+// path, sends req, and returns the response. A response that
+// reports an error is returned as an error.
+func SendControlRequest(path string, req *ControlRequest, timeout time.Duration) (*ControlResponse, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	res := &ControlResponse{}
+	if err := json.NewDecoder(conn).Decode(res); err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+	return res, nil
+}
@@ -0,0 +1,48 @@
+package sleepingd
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ControlServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	server, err := NewControlServer(path, func(req *ControlRequest) *ControlResponse {
+		if req.Command != "status" {
+			return &ControlResponse{Error: "unknown command: " + req.Command}
+		}
+		return &ControlResponse{Apps: []*AppStatus{{Name: req.App, Running: true, Pid: 42}}}
+	})
+	require.NoError(t, err)
+	defer server.Close()
+	res, err := SendControlRequest(path, &ControlRequest{Command: "status", App: "web"}, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, []*AppStatus{{Name: "web", Running: true, Pid: 42}}, res.Apps)
+	_, err = SendControlRequest(path, &ControlRequest{Command: "explode"}, time.Second)
+	assert.EqualError(t, err, "unknown command: explode")
+}
+
+func Test_ControlServer_StaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	// Leave a socket file behind without anything listening on
+	// it, like a previous process that crashed.
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, l.Close())
+	server, err := NewControlServer(path, func(req *ControlRequest) *ControlResponse {
+		return &ControlResponse{}
+	})
+	require.NoError(t, err)
+	// But refuse to take over a socket that is still in use.
+	_, err = NewControlServer(path, func(req *ControlRequest) *ControlResponse {
+		return &ControlResponse{}
+	})
+	assert.Error(t, err)
+	require.NoError(t, server.Close())
+}
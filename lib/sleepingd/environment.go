@@ -0,0 +1,161 @@
+package sleepingd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// matchesEnvPattern reports whether the environment variable name
+// matches pattern, which is either an exact name or a prefix followed
+// by "*", e.g. "SLEEPING_BEAUTY_*".
+func matchesEnvPattern(name string, pattern string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(name, prefix)
+	}
+	return name == pattern
+}
+
+func matchesAnyEnvPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matchesEnvPattern(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// ChildEnvironment returns the environment for an application's
+// subprocess, as a list of "KEY=value" strings. It starts from
+// inherited (normally os.Environ()), keeping only the variables
+// matching opts.EnvAllowlist if it is non-empty, and removing the
+// variables matching opts.UnsetEnv. Then the variables from each of
+// opts.EnvFiles are added in order, and finally those from opts.Env.
+// Later values take precedence over earlier ones.
+func ChildEnvironment(opts *AppOptions, inherited []string) ([]string, error) {
+	env := map[string]string{}
+	for _, kv := range inherited {
+		key, value, _ := strings.Cut(kv, "=")
+		if len(opts.EnvAllowlist) > 0 && !matchesAnyEnvPattern(key, opts.EnvAllowlist) {
+			continue
+		}
+		if matchesAnyEnvPattern(key, opts.UnsetEnv) {
+			continue
+		}
+		env[key] = value
+	}
+	for _, path := range opts.EnvFiles {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		vars, err := ParseDotenv(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for _, kv := range vars {
+			env[kv[0]] = kv[1]
+		}
+	}
+	for key, value := range opts.Env {
+		env[key] = value
+	}
+	result := []string{}
+	for key, value := range env {
+		result = append(result, key+"="+value)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+var dotenvComment = regexp.MustCompile(`\s#.*$`)
+
+var dotenvLine = regexp.MustCompile(`^\s*(?:export\s+)?([A-Za-z_][A-Za-z0-9_]*)\s*=\s*(.*?)\s*$`)
+
+// ParseDotenv reads environment variables from a dotenv file, and
+// returns them in order as key-value pairs. Each line is of the form
+// KEY=value, optionally preceded by "export". Blank lines and lines
+// starting with # are ignored. Values may be single-quoted (taken
+// literally), double-quoted (with backslash escapes \n, \t, \", \\,
+// and \$), or unquoted (in which case a # preceded by whitespace
+// starts a comment). Variable references in values are not expanded.
+func ParseDotenv(r io.Reader) ([][2]string, error) {
+	vars := [][2]string{}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum += 1
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		match := dotenvLine.FindStringSubmatch(line)
+		if match == nil {
+			return nil, fmt.Errorf("line %d: expected KEY=value", lineNum)
+		}
+		value, err := parseDotenvValue(match[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		vars = append(vars, [2]string{match[1], value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+func parseDotenvValue(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+	switch raw[0] {
+	case '\'':
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated single quote")
+		}
+		if rest := strings.TrimSpace(raw[end+2:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected text after closing quote")
+		}
+		return raw[1 : end+1], nil
+	case '"':
+		value := strings.Builder{}
+		for i := 1; i < len(raw); i++ {
+			switch raw[i] {
+			case '\\':
+				i += 1
+				if i >= len(raw) {
+					return "", fmt.Errorf("unterminated double quote")
+				}
+				switch raw[i] {
+				case 'n':
+					value.WriteByte('\n')
+				case 't':
+					value.WriteByte('\t')
+				case '"', '\\', '$':
+					value.WriteByte(raw[i])
+				default:
+					value.WriteByte('\\')
+					value.WriteByte(raw[i])
+				}
+			case '"':
+				if rest := strings.TrimSpace(raw[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+					return "", fmt.Errorf("unexpected text after closing quote")
+				}
+				return value.String(), nil
+			default:
+				value.WriteByte(raw[i])
+			}
+		}
+		return "", fmt.Errorf("unterminated double quote")
+	default:
+		return strings.TrimSpace(dotenvComment.ReplaceAllString(raw, "")), nil
+	}
+}
@@ -0,0 +1,78 @@
+package sleepingd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseDotenv(t *testing.T) {
+	vars, err := ParseDotenv(strings.NewReader(`
+# comment
+PLAIN=hello world
+export EXPORTED=yes
+SPACED = value   # trailing comment
+HASH=a#b
+SINGLE='literal \n $HOME' # comment
+DOUBLE="line one\nline \"two\""
+EMPTY=
+`))
+	require.NoError(t, err)
+	assert.Equal(t, [][2]string{
+		{"PLAIN", "hello world"},
+		{"EXPORTED", "yes"},
+		{"SPACED", "value"},
+		{"HASH", "a#b"},
+		{"SINGLE", `literal \n $HOME`},
+		{"DOUBLE", "line one\nline \"two\""},
+		{"EMPTY", ""},
+	}, vars)
+}
+
+func Test_ParseDotenv_Errors(t *testing.T) {
+	_, err := ParseDotenv(strings.NewReader("A=1\nnot a variable\n"))
+	assert.EqualError(t, err, "line 2: expected KEY=value")
+	_, err = ParseDotenv(strings.NewReader("A=\"unterminated\n"))
+	assert.EqualError(t, err, "line 1: unterminated double quote")
+	_, err = ParseDotenv(strings.NewReader("A='x' y\n"))
+	assert.EqualError(t, err, "line 1: unexpected text after closing quote")
+}
+
+func Test_ChildEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, ".env")
+	require.NoError(t, os.WriteFile(envFile, []byte("FROM_FILE=1\nOVERRIDDEN=file\n"), 0o644))
+	inherited := []string{
+		"PATH=/usr/bin",
+		"HOME=/root",
+		"SLEEPING_BEAUTY_COMMAND=node server.js",
+		"SLEEPING_BEAUTY_LISTEN_PORT=80",
+	}
+	env, err := ChildEnvironment(&AppOptions{
+		UnsetEnv: []string{"SLEEPING_BEAUTY_*"},
+		EnvFiles: []string{envFile},
+		Env:      map[string]string{"OVERRIDDEN": "config", "EXTRA": "2"},
+	}, inherited)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"EXTRA=2",
+		"FROM_FILE=1",
+		"HOME=/root",
+		"OVERRIDDEN=config",
+		"PATH=/usr/bin",
+	}, env)
+	env, err = ChildEnvironment(&AppOptions{
+		EnvAllowlist: []string{"PATH"},
+		Env:          map[string]string{"EXTRA": "2"},
+	}, inherited)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"EXTRA=2", "PATH=/usr/bin"}, env)
+	_, err = ChildEnvironment(&AppOptions{
+		EnvFiles: []string{filepath.Join(dir, "missing.env")},
+	}, inherited)
+	assert.Error(t, err)
+}
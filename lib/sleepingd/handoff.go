@@ -0,0 +1,170 @@
+package sleepingd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ExecWithListenPIDCommand is the name of the sleepingd subcommand
+// that runs ExecWithListenPID. In handoff mode, the command is run
+// through it.
+const ExecWithListenPIDCommand = "exec-with-listen-pid"
+
+// ExecWithListenPID replaces the current process with argv, after
+// setting LISTEN_PID to the pid of the current process. This is
+// needed to pass sockets to a subprocess with the socket activation
+// protocol of sd_listen_fds(3), since LISTEN_PID has to be the pid of
+// the subprocess, which is not known until after it is started.
+func ExecWithListenPID(argv []string) error {
+	if len(argv) == 0 {
+		return errors.New("no command given")
+	}
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		return err
+	}
+	env := []string{}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_PID=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, fmt.Sprintf("LISTEN_PID=%d", os.Getpid()))
+	return syscall.Exec(path, argv, env)
+}
+
+// withoutListenEnv returns env without the socket activation
+// variables, see sd_listen_fds(3).
+func withoutListenEnv(env []string) []string {
+	filtered := []string{}
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if name != "LISTEN_PID" && name != "LISTEN_FDS" && name != "LISTEN_FDNAMES" {
+			filtered = append(filtered, kv)
+		}
+	}
+	return filtered
+}
+
+// handoffEnvironment returns env with the variables set that tell a
+// subprocess that it has been passed a single socket named name,
+// other than LISTEN_PID, see ExecWithListenPID.
+func handoffEnvironment(env []string, name string) []string {
+	return append(withoutListenEnv(env), "LISTEN_FDS=1", "LISTEN_FDNAMES="+name)
+}
+
+// fileListener is a listener whose socket can be passed to another
+// process, e.g. *net.TCPListener or *net.UnixListener.
+type fileListener interface {
+	net.Listener
+	syscall.Conn
+	File() (*os.File, error)
+}
+
+func newHandoffProxy(l net.Listener, opts *ProxyOptions) (*Proxy, error) {
+	fl, ok := l.(fileListener)
+	if !ok {
+		_ = l.Close()
+		return nil, errors.New("handoff mode needs a plain TCP or Unix domain socket listener")
+	}
+	p := &Proxy{
+		listener: l,
+	}
+	go p.serveHandoff(fl, opts)
+	return p, nil
+}
+
+// serveHandoff waits for a connection on l, and then calls
+// opts.Handoff to start the upstream with the listening socket. The
+// upstream accepts further connections itself, until it exits, after
+// which the proxy waits for the next connection again.
+func (p *Proxy) serveHandoff(l fileListener, opts *ProxyOptions) {
+	// pending has the local addresses of the connections made by
+	// the proxy to the socket, see below. If the upstream exits
+	// without accepting one of them, then the proxy accepts it
+	// itself, and must not take it for a new client.
+	pendingLock := sync.Mutex{}
+	pending := map[string]bool{}
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		}
+		pendingLock.Lock()
+		own := pending[conn.RemoteAddr().String()]
+		pendingLock.Unlock()
+		if own {
+			_ = conn.Close()
+			continue
+		}
+		f, err := l.File()
+		if err != nil {
+			LogError(err)
+			_ = conn.Close()
+			continue
+		}
+		exited := opts.Handoff(p, f)
+		// The upstream has its own copy now, if it started.
+		_ = f.Close()
+		if exited == nil {
+			_ = conn.Close()
+			setNonblock(l)
+			continue
+		}
+		// The connection that woke the upstream has already
+		// been accepted, so it is proxied by connecting to the
+		// socket again, where the upstream will accept it.
+		go func() {
+			addr := ""
+			p.serveConn(conn, opts, func() (net.Conn, error) {
+				uc, err := dialListener(l)
+				if err == nil && uc.LocalAddr().Network() == "tcp" {
+					addr = uc.LocalAddr().String()
+					pendingLock.Lock()
+					pending[addr] = true
+					pendingLock.Unlock()
+				}
+				return uc, err
+			})
+			pendingLock.Lock()
+			delete(pending, addr)
+			pendingLock.Unlock()
+		}()
+		<-exited
+		setNonblock(l)
+	}
+}
+
+// setNonblock puts the socket of l back into non-blocking mode, which
+// is needed for Accept to work properly, after it has been passed to
+// a subprocess (which makes it blocking, see os.File.Fd).
+func setNonblock(l syscall.Conn) {
+	rc, err := l.SyscallConn()
+	if err != nil {
+		return
+	}
+	_ = rc.Control(func(fd uintptr) {
+		LogError(syscall.SetNonblock(int(fd), true))
+	})
+}
+
+// dialListener connects to the address that l is listening on.
+func dialListener(l net.Listener) (net.Conn, error) {
+	addr := l.Addr()
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok && tcpAddr.IP.IsUnspecified() {
+		loopback := net.IPv4(127, 0, 0, 1)
+		if tcpAddr.IP.To4() == nil {
+			loopback = net.IPv6loopback
+		}
+		addr = &net.TCPAddr{IP: loopback, Port: tcpAddr.Port}
+	}
+	return net.Dial(addr.Network(), addr.String())
+}
@@ -0,0 +1,95 @@
+package sleepingd
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_HandoffEnvironment(t *testing.T) {
+	env := handoffEnvironment([]string{"HOME=/root", "LISTEN_PID=1", "LISTEN_FDS=2", "LISTEN_FDNAMES=a:b"}, "web")
+	assert.Equal(t, []string{"HOME=/root", "LISTEN_FDS=1", "LISTEN_FDNAMES=web"}, env)
+}
+
+// handoffUpstream plays the part of an application that supports
+// socket activation, for ProxyOptions.Handoff. It accepts
+// connections from the socket it is passed, reads a 5 byte request
+// from each client and replies with its address, until stop is
+// called.
+type handoffUpstream struct {
+	t         *testing.T
+	numStarts atomic.Int32
+	listener  net.Listener
+	exited    chan struct{}
+}
+
+func (u *handoffUpstream) handoff(p *Proxy, f *os.File) <-chan struct{} {
+	u.numStarts.Add(1)
+	l, err := net.FileListener(f)
+	require.NoError(u.t, err)
+	u.listener = l
+	u.exited = make(chan struct{})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = io.ReadFull(conn, make([]byte, 5))
+			_, _ = conn.Write([]byte(conn.RemoteAddr().String()))
+			_ = conn.Close()
+		}
+	}()
+	return u.exited
+}
+
+func (u *handoffUpstream) stop() {
+	_ = u.listener.Close()
+	close(u.exited)
+}
+
+func Test_Proxy_Handoff(t *testing.T) {
+	upstream := &handoffUpstream{t: t}
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:   "tcp",
+		ListenAddr: "127.0.0.1:7001",
+		Handoff:    upstream.handoff,
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	// Returns the address that the upstream saw, and the local
+	// address of the client
+	request := func() (string, string) {
+		conn, err := net.Dial("tcp", "127.0.0.1:7001")
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		data, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return string(data), conn.LocalAddr().String()
+	}
+	// The first connection is proxied
+	seen, client := request()
+	assert.NotEqual(t, client, seen)
+	assert.Equal(t, int32(1), upstream.numStarts.Load())
+	// Later connections go straight to the upstream
+	seen, client = request()
+	assert.Equal(t, client, seen)
+	assert.Equal(t, int32(1), upstream.numStarts.Load())
+	// Once the upstream exits, the next connection starts it
+	// again
+	upstream.stop()
+	time.Sleep(50 * time.Millisecond)
+	seen, client = request()
+	assert.NotEqual(t, client, seen)
+	assert.Equal(t, int32(2), upstream.numStarts.Load())
+	upstream.stop()
+}
@@ -0,0 +1,341 @@
+package sleepingd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultWakingPage is served to browsers by an HTTP proxy while the
+// upstream is starting, unless HTTPOptions.WakingPage is set. It
+// reloads itself after a few seconds.
+const DefaultWakingPage = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <meta http-equiv="refresh" content="%d">
+    <title>Waking up</title>
+  </head>
+  <body>
+    <p>This application is waking up. The page will reload automatically in a few seconds.</p>
+  </body>
+</html>
+`
+
+// HTTPOptions configures the HTTP mode of a proxy, see ProxyOptions.
+type HTTPOptions struct {
+	// WakeTimeout is how long to hold a request while the
+	// upstream is starting, before giving up and responding
+	// with 503 Service Unavailable. If zero, then requests are
+	// not held at all: the upstream is woken up in the
+	// background, and 503 is returned immediately.
+	WakeTimeout time.Duration
+	// RetryAfter is sent in the Retry-After header of 503
+	// responses, and used as the refresh interval of the default
+	// waking page.
+	RetryAfter time.Duration
+	// WakingPage is the HTML served with 503 responses to
+	// clients that accept HTML, optional. It defaults to
+	// DefaultWakingPage. Other clients get a plain text message.
+	WakingPage []byte
+	// HealthChecks lists requests that are used by load
+	// balancers and the like to check whether the upstream is
+	// up, optional. They never count as activity: they are
+	// answered with HealthCheckStatus and HealthCheckBody while
+	// the upstream is not running (without starting it), and
+	// otherwise proxied without calling DataCallback.
+	HealthChecks      []HealthCheck
+	HealthCheckStatus int
+	HealthCheckBody   []byte
+}
+
+// HealthCheck identifies health check requests, see HTTPOptions.
+type HealthCheck struct {
+	// Method is the request method, e.g. "GET", or empty to
+	// match any method.
+	Method string
+	// Path is the request path, which must match exactly.
+	Path string
+}
+
+// ParseHealthCheck parses a health check in the format "/path" or
+// "METHOD /path".
+func ParseHealthCheck(s string) (HealthCheck, error) {
+	fields := strings.Fields(s)
+	switch {
+	case len(fields) == 1 && strings.HasPrefix(fields[0], "/"):
+		return HealthCheck{Path: fields[0]}, nil
+	case len(fields) == 2 && strings.HasPrefix(fields[1], "/"):
+		return HealthCheck{Method: strings.ToUpper(fields[0]), Path: fields[1]}, nil
+	default:
+		return HealthCheck{}, fmt.Errorf("invalid health check %q, expected /path or METHOD /path", s)
+	}
+}
+
+func (hc HealthCheck) matches(r *http.Request) bool {
+	return r.URL.Path == hc.Path && (hc.Method == "" || hc.Method == r.Method)
+}
+
+// activityConn calls callback whenever data is read from or written
+// to the underlying connection.
+type activityConn struct {
+	net.Conn
+	callback func()
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.callback != nil {
+		c.callback()
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 && c.callback != nil {
+		c.callback()
+	}
+	return n, err
+}
+
+// httpProxy is the http.Handler used by a Proxy in HTTP mode.
+type httpProxy struct {
+	proxy        *Proxy
+	opts         *ProxyOptions
+	reverseProxy *httputil.ReverseProxy
+	// quietProxy is used for health checks and for clients that
+	// are not allowed to keep the upstream awake, and does not
+	// report activity.
+	quietProxy *httputil.ReverseProxy
+}
+
+// HTTPOptions returns the options for HTTP mode, or nil if the proxy
+// is not in HTTP mode.
+func (p *Proxy) HTTPOptions() *HTTPOptions {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.httpOptions
+}
+
+// SetHTTPOptions changes the options for HTTP mode. It has no effect
+// if the proxy is not in HTTP mode, since the mode cannot be changed
+// after the proxy is started.
+func (p *Proxy) SetHTTPOptions(opts *HTTPOptions) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.httpOptions != nil {
+		p.httpOptions = opts
+	}
+}
+
+func newHTTPProxy(l net.Listener, opts *ProxyOptions) *Proxy {
+	p := &Proxy{
+		listener:         l,
+		upstreamProtocol: opts.upstreamProtocol(),
+		upstreamAddr:     opts.UpstreamAddr,
+		httpOptions:      opts.HTTP,
+	}
+	h := &httpProxy{
+		proxy:        p,
+		opts:         opts,
+		reverseProxy: p.newReverseProxy(opts, opts.DataCallback),
+		quietProxy:   p.newReverseProxy(opts, nil),
+	}
+	// maxAgeTimers maps each client connection to the timer that
+	// closes it once it reaches opts.MaxAge.
+	maxAgeTimers := &sync.Map{}
+	p.server = &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       opts.IdleTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, clientConnKey{}, c)
+		},
+		ConnState: func(c net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				p.active.Add(1)
+				if opts.MaxAge > 0 {
+					maxAgeTimers.Store(c, time.AfterFunc(opts.MaxAge, func() {
+						_ = c.Close()
+					}))
+				}
+			case http.StateHijacked, http.StateClosed:
+				p.active.Add(-1)
+				if timer, ok := maxAgeTimers.LoadAndDelete(c); ok {
+					timer.(*time.Timer).Stop()
+				}
+			}
+		},
+	}
+	go p.server.Serve(l)
+	return p
+}
+
+// clientConnKey is the context key for the client connection of an
+// HTTP request, see http.Server.ConnContext.
+type clientConnKey struct{}
+
+// newReverseProxy returns a reverse proxy to the upstream, which
+// calls dataCallback (if not nil) whenever data is sent or received.
+// Connections are retried according to opts.DialAttempts, and start
+// with a PROXY protocol header if opts.SendProxyHeader is set.
+func (p *Proxy) newReverseProxy(opts *ProxyOptions, dataCallback func()) *httputil.ReverseProxy {
+	proxyHeader := opts.SendProxyHeader
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			client := ctx.Value(clientConnKey{}).(net.Conn)
+			conn, err := p.dialWithRetries(ctx, client.RemoteAddr(), opts)
+			if err != nil {
+				return nil, err
+			}
+			if proxyHeader != 0 {
+				err := WriteProxyHeader(conn, proxyHeader, client.RemoteAddr(), client.LocalAddr())
+				if err != nil {
+					_ = conn.Close()
+					return nil, err
+				}
+			}
+			return &activityConn{Conn: conn, callback: dataCallback}, nil
+		},
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+		// Each connection to the upstream belongs to a single
+		// client if it starts with a PROXY protocol header,
+		// so it cannot be reused for other requests.
+		DisableKeepAlives: proxyHeader != 0,
+	}
+	p.transports = append(p.transports, transport)
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			// The address is ignored by the dialer, but it
+			// has to be set to something.
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = "upstream"
+			r.SetXForwarded()
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if !wakeErrorIsExpected(err) {
+				LogError(fmt.Errorf("proxying %s %s: %w", r.Method, r.URL.Path, err))
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+func (h *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client := r.Context().Value(clientConnKey{}).(net.Conn).RemoteAddr()
+	if !h.opts.ConnectFrom.Allows(client) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if h.isHealthCheck(r) {
+		if h.opts.ReadyCallback != nil && !h.opts.ReadyCallback() {
+			opts := h.proxy.HTTPOptions()
+			w.WriteHeader(opts.HealthCheckStatus)
+			_, _ = w.Write(opts.HealthCheckBody)
+			return
+		}
+		h.quietProxy.ServeHTTP(w, r)
+		return
+	}
+	ready, err := h.wake(r, client)
+	if errors.Is(err, errWakeDenied) {
+		http.Error(w, "application is asleep", http.StatusServiceUnavailable)
+		return
+	}
+	if !ready {
+		h.serveWaking(w, r)
+		return
+	}
+	if !h.opts.KeepAwakeFrom.Allows(client) {
+		h.quietProxy.ServeHTTP(w, r)
+		return
+	}
+	h.reverseProxy.ServeHTTP(w, r)
+}
+
+func (h *httpProxy) isHealthCheck(r *http.Request) bool {
+	for _, hc := range h.proxy.HTTPOptions().HealthChecks {
+		if hc.matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// wake makes sure the upstream is starting, and reports whether it
+// is ready to receive the request, waiting up to WakeTimeout for it
+// to become ready. If client is not allowed to wake the upstream,
+// then errWakeDenied is returned.
+func (h *httpProxy) wake(r *http.Request, client net.Addr) (bool, error) {
+	if h.opts.ReadyCallback != nil && h.opts.ReadyCallback() {
+		// NewConnectionCallback is still called, as in raw
+		// mode, so that it can restart the upstream if it has
+		// exited in the meantime.
+		if err := wakeUpstream(r.Context(), h.opts, client); err != nil {
+			return false, nil
+		}
+		return h.opts.ReadyCallback(), nil
+	}
+	if !h.opts.WakeFrom.Allows(client) {
+		return false, errWakeDenied
+	}
+	wakeTimeout := h.proxy.HTTPOptions().WakeTimeout
+	if wakeTimeout <= 0 {
+		go func() {
+			_ = wakeUpstream(context.Background(), h.opts, client)
+		}()
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), wakeTimeout)
+	defer cancel()
+	if err := wakeUpstream(ctx, h.opts, client); err != nil {
+		return false, nil
+	}
+	// The upstream may still not be ready if it could not be
+	// started, e.g. because it is paused.
+	return h.opts.ReadyCallback == nil || h.opts.ReadyCallback(), nil
+}
+
+// serveWaking responds with 503 Service Unavailable, using the waking
+// page if the client accepts HTML.
+func (h *httpProxy) serveWaking(w http.ResponseWriter, r *http.Request) {
+	opts := h.proxy.HTTPOptions()
+	retryAfter := int(opts.RetryAfter.Seconds())
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Cache-Control", "no-store")
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if opts.WakingPage != nil {
+			_, _ = w.Write(opts.WakingPage)
+		} else {
+			_, _ = fmt.Fprintf(w, DefaultWakingPage, retryAfter)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = fmt.Fprintf(w, "application is starting, retry after %d seconds\n", retryAfter)
+}
+
+// CloseIdleConnections closes any idle keep-alive connections to the
+// upstream in HTTP mode. It should be called when the upstream is
+// stopped, since the connections will not work anymore. It does
+// nothing in other modes.
+func (p *Proxy) CloseIdleConnections() {
+	for _, transport := range p.transports {
+		transport.CloseIdleConnections()
+	}
+}
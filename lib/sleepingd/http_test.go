@@ -0,0 +1,340 @@
+package sleepingd
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// getHTTPUpstream returns a function that starts an HTTP server on
+// port 7000 after delay, for use as a NewConnectionCallback, and a
+// function that reports whether the server has been started, for use
+// as a ReadyCallback. The server echoes back the X-Forwarded-For
+// header.
+func getHTTPUpstream(t *testing.T, delay time.Duration) (func() error, func() bool) {
+	ready := &atomic.Bool{}
+	started := &atomic.Bool{}
+	start := func() error {
+		if started.Swap(true) {
+			for !ready.Load() {
+				time.Sleep(10 * time.Millisecond)
+			}
+			return nil
+		}
+		time.Sleep(delay)
+		server := &http.Server{
+			Addr: "127.0.0.1:7000",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte("forwarded for " + r.Header.Get("X-Forwarded-For")))
+			}),
+		}
+		go server.ListenAndServe()
+		t.Cleanup(func() { server.Close() })
+		for !portInUse("tcp", "127.0.0.1", 7000) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		ready.Store(true)
+		return nil
+	}
+	return start, ready.Load
+}
+
+func httpGet(t *testing.T, url string, accept string) (*http.Response, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(body)
+}
+
+func Test_HTTPProxy_Hold(t *testing.T) {
+	start, ready := getHTTPUpstream(t, 200*time.Millisecond)
+	numData := &atomic.Int32{}
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:              "tcp",
+		ListenAddr:            "127.0.0.1:7001",
+		UpstreamAddr:          "127.0.0.1:7000",
+		NewConnectionCallback: start,
+		ReadyCallback:         ready,
+		DataCallback:          func() { numData.Add(1) },
+		HTTP: &HTTPOptions{
+			WakeTimeout: 2 * time.Second,
+			RetryAfter:  5 * time.Second,
+		},
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	res, body := httpGet(t, "http://127.0.0.1:7001/", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "forwarded for 127.0.0.1", body)
+	assert.NotZero(t, numData.Load())
+}
+
+func Test_HTTPProxy_HoldTimeout(t *testing.T) {
+	start, ready := getHTTPUpstream(t, 500*time.Millisecond)
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:              "tcp",
+		ListenAddr:            "127.0.0.1:7001",
+		UpstreamAddr:          "127.0.0.1:7000",
+		NewConnectionCallback: start,
+		ReadyCallback:         ready,
+		HTTP: &HTTPOptions{
+			WakeTimeout: 100 * time.Millisecond,
+			RetryAfter:  5 * time.Second,
+		},
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	res, body := httpGet(t, "http://127.0.0.1:7001/", "application/json")
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, "5", res.Header.Get("Retry-After"))
+	assert.Equal(t, "application is starting, retry after 5 seconds\n", body)
+	// The upstream keeps starting in the background
+	time.Sleep(600 * time.Millisecond)
+	res, _ = httpGet(t, "http://127.0.0.1:7001/", "application/json")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func Test_HTTPProxy_Immediate(t *testing.T) {
+	start, ready := getHTTPUpstream(t, 100*time.Millisecond)
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:              "tcp",
+		ListenAddr:            "127.0.0.1:7001",
+		UpstreamAddr:          "127.0.0.1:7000",
+		NewConnectionCallback: start,
+		ReadyCallback:         ready,
+		HTTP: &HTTPOptions{
+			RetryAfter: 3 * time.Second,
+		},
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	res, body := httpGet(t, "http://127.0.0.1:7001/", "text/html,application/xhtml+xml")
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, "3", res.Header.Get("Retry-After"))
+	assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Contains(t, body, `<meta http-equiv="refresh" content="3">`)
+	proxy.SetHTTPOptions(&HTTPOptions{
+		RetryAfter: 3 * time.Second,
+		WakingPage: []byte("custom page"),
+	})
+	res, body = httpGet(t, "http://127.0.0.1:7001/", "text/html")
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, "custom page", body)
+	time.Sleep(300 * time.Millisecond)
+	res, _ = httpGet(t, "http://127.0.0.1:7001/", "text/html")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func Test_HTTPProxy_DialRetry(t *testing.T) {
+	// The upstream claims to be ready, but is not listening yet,
+	// e.g. because it has crashed and is being restarted.
+	numWakes := &atomic.Int32{}
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:     "tcp",
+		ListenAddr:   "127.0.0.1:7001",
+		UpstreamAddr: "127.0.0.1:7000",
+		NewConnectionCallback: func() error {
+			numWakes.Add(1)
+			return nil
+		},
+		ReadyCallback: func() bool { return true },
+		DialAttempts:  5,
+		DialBackoff:   100 * time.Millisecond,
+		HTTP: &HTTPOptions{
+			RetryAfter: 5 * time.Second,
+		},
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	start, _ := getHTTPUpstream(t, 200*time.Millisecond)
+	go start()
+	res, body := httpGet(t, "http://127.0.0.1:7001/", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "forwarded for 127.0.0.1", body)
+	// Woken up for the request even though it was ready, and
+	// again before each retry
+	assert.Greater(t, numWakes.Load(), int32(2))
+}
+
+func Test_HTTPProxy_Timeouts(t *testing.T) {
+	tests := []struct {
+		Description string
+		IdleTimeout time.Duration
+		MaxAge      time.Duration
+		// Interval between requests on the same keep-alive
+		// connection
+		Interval time.Duration
+	}{
+		{
+			Description: "idle keep-alive connection is closed",
+			IdleTimeout: 200 * time.Millisecond,
+			Interval:    400 * time.Millisecond,
+		},
+		{
+			Description: "active keep-alive connection is closed at max age",
+			MaxAge:      300 * time.Millisecond,
+			Interval:    100 * time.Millisecond,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			start, ready := getHTTPUpstream(t, 0)
+			require.NoError(t, start())
+			proxy, err := NewProxy(&ProxyOptions{
+				Protocol:              "tcp",
+				ListenAddr:            "127.0.0.1:7001",
+				UpstreamAddr:          "127.0.0.1:7000",
+				NewConnectionCallback: start,
+				ReadyCallback:         ready,
+				IdleTimeout:           test.IdleTimeout,
+				MaxAge:                test.MaxAge,
+				HTTP: &HTTPOptions{
+					RetryAfter: 5 * time.Second,
+				},
+			})
+			require.NoError(t, err)
+			defer proxy.Close()
+			conn, err := net.Dial("tcp", "127.0.0.1:7001")
+			require.NoError(t, err)
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			begin := time.Now()
+			for time.Since(begin) < time.Second {
+				_, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+				if err != nil {
+					break
+				}
+				require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+				res, err := http.ReadResponse(reader, nil)
+				if err != nil {
+					break
+				}
+				_, _ = io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+				time.Sleep(test.Interval)
+			}
+			// Closed by the proxy rather than timing out
+			// on our side
+			assert.Less(t, time.Since(begin), time.Second)
+		})
+	}
+}
+
+func Test_HTTPProxy_HealthCheck(t *testing.T) {
+	start, ready := getHTTPUpstream(t, 0)
+	numWakes := &atomic.Int32{}
+	numData := &atomic.Int32{}
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:     "tcp",
+		ListenAddr:   "127.0.0.1:7001",
+		UpstreamAddr: "127.0.0.1:7000",
+		NewConnectionCallback: func() error {
+			numWakes.Add(1)
+			return start()
+		},
+		ReadyCallback: ready,
+		DataCallback:  func() { numData.Add(1) },
+		HTTP: &HTTPOptions{
+			WakeTimeout:       time.Second,
+			RetryAfter:        time.Second,
+			HealthChecks:      []HealthCheck{{Method: "GET", Path: "/healthz"}},
+			HealthCheckStatus: http.StatusOK,
+			HealthCheckBody:   []byte("asleep"),
+		},
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	// Answered locally while asleep, without waking up
+	res, body := httpGet(t, "http://127.0.0.1:7001/healthz", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "asleep", body)
+	assert.Zero(t, numWakes.Load())
+	// Other paths wake the upstream
+	res, _ = httpGet(t, "http://127.0.0.1:7001/healthz/other", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, int32(1), numWakes.Load())
+	// Proxied while awake, without counting as activity
+	numData.Store(0)
+	res, body = httpGet(t, "http://127.0.0.1:7001/healthz", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "forwarded for 127.0.0.1", body)
+	assert.Zero(t, numData.Load())
+}
+
+func Test_ParseHealthCheck(t *testing.T) {
+	hc, err := ParseHealthCheck("/healthz")
+	assert.NoError(t, err)
+	assert.Equal(t, HealthCheck{Path: "/healthz"}, hc)
+	hc, err = ParseHealthCheck("head /healthz")
+	assert.NoError(t, err)
+	assert.Equal(t, HealthCheck{Method: "HEAD", Path: "/healthz"}, hc)
+	_, err = ParseHealthCheck("healthz")
+	assert.Error(t, err)
+	_, err = ParseHealthCheck("GET /a /b")
+	assert.Error(t, err)
+}
+
+func Test_HTTPProxy_ClientRules(t *testing.T) {
+	start, ready := getHTTPUpstream(t, 0)
+	denyLocal, err := ParseClientRules([]string{"!127.0.0.1"})
+	require.NoError(t, err)
+	numData := &atomic.Int32{}
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:              "tcp",
+		ListenAddr:            "127.0.0.1:7001",
+		UpstreamAddr:          "127.0.0.1:7000",
+		NewConnectionCallback: start,
+		ReadyCallback:         ready,
+		DataCallback:          func() { numData.Add(1) },
+		WakeFrom:              denyLocal,
+		KeepAwakeFrom:         denyLocal,
+		HTTP: &HTTPOptions{
+			WakeTimeout: 2 * time.Second,
+			RetryAfter:  5 * time.Second,
+		},
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	res, body := httpGet(t, "http://127.0.0.1:7001/", "")
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, "application is asleep\n", body)
+	assert.False(t, ready())
+	// Once someone else has woken it up, the client can use it,
+	// but does not keep it awake
+	require.NoError(t, start())
+	res, body = httpGet(t, "http://127.0.0.1:7001/", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "forwarded for 127.0.0.1", body)
+	assert.Zero(t, numData.Load())
+	// Clients that may not connect never reach the upstream
+	proxy.Close()
+	proxy, err = NewProxy(&ProxyOptions{
+		Protocol:              "tcp",
+		ListenAddr:            "127.0.0.1:7001",
+		UpstreamAddr:          "127.0.0.1:7000",
+		NewConnectionCallback: start,
+		ReadyCallback:         ready,
+		ConnectFrom:           denyLocal,
+		HTTP:                  &HTTPOptions{},
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	res, _ = httpGet(t, "http://127.0.0.1:7001/", "")
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
@@ -1,9 +1,13 @@
 package sleepingd
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"os"
 	"sync"
+	"time"
 )
 
 type closedConn struct {
@@ -37,12 +41,19 @@ type lazyConn struct {
 	opened sync.WaitGroup
 	lock   sync.Mutex
 	conn   SimpleConn
+	// opening is set while connGetter is running, which happens
+	// without holding lock, so that Close does not have to wait
+	// for it.
+	opening bool
 }
 
 type LazyConn interface {
 	Read(p []byte) (int, error)
 	Write(p []byte) (int, error)
 	Close() error
+	// Open opens the underlying connection now, if it has not
+	// been opened or closed yet.
+	Open() error
 }
 
 func NewLazyConn(connGetter func() (SimpleConn, error), openOnRead bool, openOnWrite bool) LazyConn {
@@ -56,24 +67,46 @@ func NewLazyConn(connGetter func() (SimpleConn, error), openOnRead bool, openOnW
 }
 
 func (lc *lazyConn) ensureOpen() error {
+	lc.lock.Lock()
+	if lc.conn != nil {
+		lc.lock.Unlock()
+		return nil
+	}
+	if lc.opening {
+		lc.lock.Unlock()
+		lc.opened.Wait()
+		return nil
+	}
+	lc.opening = true
+	lc.lock.Unlock()
+	conn, err := lc.connGetter()
 	lc.lock.Lock()
 	defer lc.lock.Unlock()
-	if lc.conn == nil {
-		conn, err := lc.connGetter()
-		if err != nil {
-			lc.conn = &closedConn{
-				readError:  err,
-				writeError: err,
-			}
-			lc.opened.Done()
-			return err
+	if lc.conn != nil {
+		// Closed in the meantime, so nobody is going to use
+		// the new connection.
+		if err == nil {
+			_ = conn.Close()
+		}
+		return fmt.Errorf("lazy connection was closed while being initialized")
+	}
+	if err != nil {
+		lc.conn = &closedConn{
+			readError:  err,
+			writeError: err,
 		}
-		lc.conn = conn
 		lc.opened.Done()
+		return err
 	}
+	lc.conn = conn
+	lc.opened.Done()
 	return nil
 }
 
+func (lc *lazyConn) Open() error {
+	return lc.ensureOpen()
+}
+
 func (lc *lazyConn) Read(p []byte) (int, error) {
 	if !lc.openOnRead {
 		lc.opened.Wait()
@@ -126,6 +159,31 @@ func (lc *lazyConn) Close() error {
 	return lc.conn.Close()
 }
 
+// CloseWrite shuts down writing to the underlying connection, see
+// closeWrite. It fails if the connection was never opened, since
+// there is nobody to tell.
+func (lc *lazyConn) CloseWrite() error {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	if lc.conn == nil {
+		return fmt.Errorf("lazy connection was never opened")
+	}
+	return closeWrite(lc.conn)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying
+// connection, if it supports that. It does nothing if the connection
+// is not open yet, since the write that opens it would not block
+// anyway.
+func (lc *lazyConn) SetWriteDeadline(t time.Time) error {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	if wd, ok := lc.conn.(writeDeadliner); ok {
+		return wd.SetWriteDeadline(t)
+	}
+	return nil
+}
+
 // Global variable to keep track of how many CopyWithActivity sessions
 // are currently active. This should not remain nonzero for
 // significant amounts of time unless there is active traffic, if it
@@ -133,16 +191,50 @@ func (lc *lazyConn) Close() error {
 var globalCopyCounter = 0
 var globalCopyLock sync.Mutex
 
+// copyBufferPool holds the buffers used by CopyWithActivity when it
+// cannot splice, so that they are not allocated for every connection.
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
+// spliceActivityInterval is how often CopyWithActivity reports
+// activity while splicing, if any data was copied. It only needs to
+// be as precise as the idle timer.
+const spliceActivityInterval = 1 * time.Second
+
 // CopyWithActivity copies all the data from src to dst, and sends a
 // signal to activityCh each time any amount of data is copied.
 // Warning: please ensure that both src.Read and dst.Write will both
 // return eventually (either with EOF or an error), because the memory
 // allocated by CopyWithActivity will not be freed until that happens.
 //
+// If both src and dst are TCP connections (possibly inside a lazy
+// connection, once it is open), then the data is spliced between
+// them in the kernel instead, see spliceWithActivity.
+//
 // This function does not return until all data is copied. The
 // returned error is nil if all data was copied, non-nil otherwise
 // (either due to a read error or a write error).
 func CopyWithActivity(dst io.Writer, src io.Reader, activityCh chan<- struct{}) error {
+	return copyWithActivity(dst, src, activityCh, 0, spliceActivityInterval)
+}
+
+// writeDeadliner is implemented by connections that support write
+// deadlines.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// copyWithActivity is CopyWithActivity, except that if writeTimeout
+// is positive and dst supports write deadlines, then writing each
+// chunk of data to dst fails with os.ErrDeadlineExceeded if it takes
+// longer than writeTimeout. While splicing, activity is reported
+// every activityInterval, which is also how often the write timeout
+// is checked.
+func copyWithActivity(dst io.Writer, src io.Reader, activityCh chan<- struct{}, writeTimeout time.Duration, activityInterval time.Duration) error {
 	globalCopyLock.Lock()
 	globalCopyCounter += 1
 	globalCopyLock.Unlock()
@@ -151,9 +243,16 @@ func CopyWithActivity(dst io.Writer, src io.Reader, activityCh chan<- struct{})
 		globalCopyCounter -= 1
 		globalCopyLock.Unlock()
 	}()
-	buf := make([]byte, 32*1024)
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+	buf := *bufp
 	// Implementation based on copyBuffer in io from stdlib
 	for {
+		// A lazy connection is not open until data is first
+		// written to it, so check again each time.
+		if tcpDst, tcpSrc := tcpConnOf(dst), tcpConnOf(src); tcpDst != nil && tcpSrc != nil {
+			return spliceWithActivity(tcpDst, tcpSrc, activityCh, writeTimeout, activityInterval)
+		}
 		nr, err := src.Read(buf)
 		if err == io.EOF {
 			return nil
@@ -163,6 +262,11 @@ func CopyWithActivity(dst io.Writer, src io.Reader, activityCh chan<- struct{})
 			continue
 		}
 		activityCh <- struct{}{}
+		if wd, ok := dst.(writeDeadliner); ok && writeTimeout > 0 {
+			if err := wd.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+				return err
+			}
+		}
 		_, err = dst.Write(buf[0:nr])
 		if err != nil {
 			return err
@@ -170,3 +274,54 @@ func CopyWithActivity(dst io.Writer, src io.Reader, activityCh chan<- struct{})
 		activityCh <- struct{}{}
 	}
 }
+
+// tcpConnOf returns the TCP connection that reads from or writes to x
+// go to directly, or nil if there is none (yet).
+func tcpConnOf(x any) *net.TCPConn {
+	switch c := x.(type) {
+	case *net.TCPConn:
+		return c
+	case *lazyConn:
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		tc, _ := c.conn.(*net.TCPConn)
+		return tc
+	}
+	return nil
+}
+
+// spliceWithActivity is like CopyWithActivity, but lets the kernel
+// copy the data using splice(2) where available, instead of copying
+// it through a buffer. Since there is no way to find out about data
+// being copied in the meantime, it sets a read deadline on src, so
+// that the copy is interrupted every activityInterval to send a
+// signal to activityCh if any data was copied. The read deadline of
+// src is overwritten, as is the write deadline of dst if writeTimeout
+// is positive, see copyWithActivity.
+func spliceWithActivity(dst, src *net.TCPConn, activityCh chan<- struct{}, writeTimeout time.Duration, activityInterval time.Duration) error {
+	for {
+		readDeadline := time.Now().Add(activityInterval)
+		err := src.SetReadDeadline(readDeadline)
+		if err != nil {
+			return err
+		}
+		// ReadFrom stops reading at the read deadline, so
+		// every write gets at least writeTimeout.
+		writeDeadline := readDeadline.Add(writeTimeout)
+		if writeTimeout > 0 {
+			if err := dst.SetWriteDeadline(writeDeadline); err != nil {
+				return err
+			}
+		}
+		n, err := dst.ReadFrom(src)
+		if n > 0 {
+			activityCh <- struct{}{}
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) && (writeTimeout <= 0 || time.Now().Before(writeDeadline)) {
+			// Only the read deadline passed
+			continue
+		}
+		// ReadFrom returns nil on EOF, like io.Copy
+		return err
+	}
+}
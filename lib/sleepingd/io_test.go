@@ -2,6 +2,9 @@ package sleepingd
 
 import (
 	"bytes"
+	"io"
+	"net"
+	"syscall"
 	"testing"
 	"time"
 
@@ -282,6 +285,40 @@ func Test_LazyConn_Basics(t *testing.T) {
 	}
 }
 
+func Test_LazyConn_CloseWhileOpening(t *testing.T) {
+	conn := newMockConn(t)
+	conn.On("Close").Return(nil).Once()
+	initChan := make(chan struct{})
+	releaseChan := make(chan struct{})
+	lazy := NewLazyConn(func() (SimpleConn, error) {
+		initChan <- struct{}{}
+		<-releaseChan
+		return conn, nil
+	}, true, true)
+	openErrChan := make(chan error)
+	go func() {
+		openErrChan <- lazy.Open()
+	}()
+	<-initChan
+	// Close does not wait for the connection to be opened
+	closed := make(chan struct{})
+	go func() {
+		assert.NoError(t, lazy.Close())
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close blocked while opening")
+	}
+	_, err := lazy.Read(make([]byte, 1))
+	assert.Error(t, err)
+	// The connection that was opened too late is closed
+	close(releaseChan)
+	assert.Error(t, <-openErrChan)
+	conn.AssertExpectations(t)
+}
+
 func Test_CopyWithActivity(t *testing.T) {
 	activityCh := make(chan struct{})
 	activityCount := 0
@@ -299,3 +336,111 @@ func Test_CopyWithActivity(t *testing.T) {
 	time.Sleep(250 * time.Millisecond)
 	assert.Greater(t, activityCount, 0)
 }
+
+// getTCPPair returns both ends of a TCP connection made over a
+// listener on addr.
+func getTCPPair(tb testing.TB, addr string) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", addr)
+	require.NoError(tb, err)
+	defer l.Close()
+	client, err := net.Dial("tcp", addr)
+	require.NoError(tb, err)
+	server, err := l.Accept()
+	require.NoError(tb, err)
+	tb.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func Test_CopyWithActivity_Splice(t *testing.T) {
+	srcClient, src := getTCPPair(t, "127.0.0.1:7000")
+	dst, dstServer := getTCPPair(t, "127.0.0.1:7001")
+	activityCh := make(chan struct{}, 100)
+	copyDone := make(chan error)
+	go func() {
+		copyDone <- CopyWithActivity(dst, src, activityCh)
+	}()
+	_, err := srcClient.Write([]byte("Hello, "))
+	require.NoError(t, err)
+	// Activity is reported while the connection stays open
+	select {
+	case <-activityCh:
+	case <-time.After(2 * spliceActivityInterval):
+		assert.Fail(t, "no activity reported")
+	}
+	_, err = srcClient.Write([]byte("world!"))
+	require.NoError(t, err)
+	require.NoError(t, srcClient.CloseWrite())
+	assert.NoError(t, <-copyDone)
+	require.NoError(t, dst.CloseWrite())
+	received, err := io.ReadAll(dstServer)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello, world!", string(received))
+}
+
+// plainConn hides the type of a connection, so that
+// CopyWithActivity cannot splice.
+type plainConn struct {
+	net.Conn
+}
+
+// cpuTime returns the user and system CPU time used by the process
+// so far.
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	require.NoError(b, syscall.Getrusage(syscall.RUSAGE_SELF, &usage))
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// benchmarkCopyWithActivity copies b.N chunks of 64 KiB from one TCP
+// connection to another, and reports the CPU time used per chunk,
+// including by the goroutines that send and receive the data.
+func benchmarkCopyWithActivity(b *testing.B, splice bool) {
+	const chunkSize = 64 * 1024
+	srcClient, src := getTCPPair(b, "127.0.0.1:7000")
+	dst, dstServer := getTCPPair(b, "127.0.0.1:7001")
+	activityCh := make(chan struct{})
+	go func() {
+		for range activityCh {
+		}
+	}()
+	defer close(activityCh)
+	go func() {
+		chunk := make([]byte, chunkSize)
+		for range b.N {
+			if _, err := srcClient.Write(chunk); err != nil {
+				return
+			}
+		}
+		_ = srcClient.CloseWrite()
+	}()
+	received := make(chan int64)
+	go func() {
+		n, _ := io.Copy(io.Discard, dstServer)
+		received <- n
+	}()
+	var copyDst io.Writer = dst
+	var copySrc io.Reader = src
+	if !splice {
+		copyDst = &plainConn{dst}
+		copySrc = &plainConn{src}
+	}
+	b.SetBytes(chunkSize)
+	b.ResetTimer()
+	startCPU := cpuTime(b)
+	require.NoError(b, CopyWithActivity(copyDst, copySrc, activityCh))
+	require.NoError(b, dst.CloseWrite())
+	require.Equal(b, int64(b.N*chunkSize), <-received)
+	b.StopTimer()
+	b.ReportMetric(float64(cpuTime(b)-startCPU)/float64(b.N), "cpu-ns/op")
+}
+
+func Benchmark_CopyWithActivity_Buffered(b *testing.B) {
+	benchmarkCopyWithActivity(b, false)
+}
+
+func Benchmark_CopyWithActivity_Splice(b *testing.B) {
+	benchmarkCopyWithActivity(b, true)
+}
@@ -1,93 +1,536 @@
 package sleepingd
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/riywo/loginshell"
 	"gopkg.in/validator.v2"
 )
 
+// Options configures sleepingd. Each field can be set either from a
+// configuration file, using the key in its yaml tag, or from an
+// environment variable, using the name in its env tag prefixed by
+// EnvPrefix. See LoadConfig.
 type Options struct {
-	Command        string `validate:"nonzero"`
-	TimeoutSeconds int    `validate:"min=1"`
-	CommandPort    int    `validate:"min=1"`
-	ListenPort     int    `validate:"min=1"`
-	ListenHost     string `validate:"nonzero"`
-	MetricsPort    int    `validate:"min=0"`
-	MetricsHost    string `validate:"nonzero"`
+	Apps        []*AppOptions `yaml:"apps" env:"-" validate:"min=1"`
+	MetricsPort int           `yaml:"metrics_port" env:"METRICS_PORT" validate:"min=0"`
+	MetricsHost string        `yaml:"metrics_host" env:"METRICS_HOST" validate:"nonzero"`
+	// ControlSocket is the path of a Unix domain socket on which
+	// to listen for commands from "sleepingd ctl", optional.
+	ControlSocket string `yaml:"control_socket" env:"CONTROL_SOCKET"`
+	// DrainTimeoutSeconds is how long to wait for connections in
+	// progress to finish upon SIGINT or SIGTERM, before stopping
+	// the applications and exiting. It defaults to 20.
+	DrainTimeoutSeconds int `yaml:"drain_timeout_seconds" env:"DRAIN_TIMEOUT_SECONDS" validate:"min=1"`
+
+	// fileApps is the list of applications in the configuration
+	// file, if any, in their original order, since Apps may be
+	// reordered or filtered by SLEEPING_BEAUTY_APPS. It is used
+	// to find the line numbers for validation errors.
+	fileApps []*AppOptions
+}
+
+// AppOptions configures a single application managed by sleepingd.
+// Each application has its own command, ports, and timeout, and is
+// put to sleep and woken up independently of the others.
+type AppOptions struct {
+	Name    string      `yaml:"name" env:"-" validate:"nonzero"`
+	Command CommandLine `yaml:"command" env:"COMMAND" validate:"command"`
+	// Shell is used to run Command if it is in shell form,
+	// optional. It defaults to the current user's login shell.
+	Shell string `yaml:"shell" env:"SHELL"`
+	// Dir is the working directory for Command, optional. It
+	// defaults to the working directory of sleepingd.
+	Dir string `yaml:"dir" env:"DIR"`
+	// Env, UnsetEnv, EnvFiles, and EnvAllowlist control the
+	// environment of Command, see ChildEnvironment. All are
+	// optional, and by default the environment of sleepingd is
+	// inherited unchanged.
+	Env            map[string]string `yaml:"env" env:"ENV" envKeyValSeparator:"="`
+	UnsetEnv       []string          `yaml:"unset_env" env:"UNSET_ENV"`
+	EnvFiles       []string          `yaml:"env_files" env:"ENV_FILES"`
+	EnvAllowlist   []string          `yaml:"env_allowlist" env:"ENV_ALLOWLIST"`
+	TimeoutSeconds int               `yaml:"timeout_seconds" env:"TIMEOUT_SECONDS" validate:"min=0"`
+	CommandPort    int               `yaml:"command_port" env:"COMMAND_PORT" validate:"min=0"`
+	ListenPort     int               `yaml:"listen_port" env:"LISTEN_PORT" validate:"min=0"`
+	ListenHost     string            `yaml:"listen_host" env:"LISTEN_HOST" validate:"nonzero"`
+	// CommandHost is the host that Command listens on, which
+	// traffic is proxied to and which is checked to see whether
+	// Command is ready. It may be an IP address (IPv4 or IPv6) or
+	// a hostname, which is looked up again for every connection,
+	// e.g. for a service in another container. It defaults to
+	// "127.0.0.1". With UDP, it must be a loopback address.
+	CommandHost string `yaml:"command_host" env:"COMMAND_HOST" validate:"nonzero"`
+	// CommandSocket is the path of a Unix domain socket that
+	// Command listens on, which is used instead of CommandPort if
+	// set.
+	CommandSocket string `yaml:"command_socket" env:"COMMAND_SOCKET"`
+	// ListenSocket is the path of a Unix domain socket to listen
+	// on, which is used instead of ListenHost and ListenPort if
+	// set. ListenSocketMode (octal, e.g. "0660") and
+	// ListenSocketOwner ("user", "user:group", or ":group")
+	// optionally set the permissions and ownership of the socket.
+	ListenSocket      string `yaml:"listen_socket" env:"LISTEN_SOCKET"`
+	ListenSocketMode  string `yaml:"listen_socket_mode" env:"LISTEN_SOCKET_MODE" validate:"regexp=^(0?[0-7]{3})?$"`
+	ListenSocketOwner string `yaml:"listen_socket_owner" env:"LISTEN_SOCKET_OWNER"`
+	// ListenFDName is the name of a socket passed by systemd with
+	// socket activation (see FileDescriptorName= in
+	// systemd.socket(5)), which is used instead of ListenSocket or
+	// ListenHost and ListenPort if set.
+	ListenFDName string `yaml:"listen_fd_name" env:"LISTEN_FD_NAME"`
+	// ExtraPorts lists more ports for the application, in addition
+	// to ListenPort and CommandPort, e.g. for an admin or gRPC
+	// endpoint, optional. Each one listens on ListenHost and is
+	// proxied in raw mode, without TLS. Traffic to any of them
+	// wakes the application and keeps it awake, and it is only
+	// considered ready once it listens on all of the command
+	// ports that are not optional.
+	ExtraPorts []PortMapping `yaml:"extra_ports" env:"EXTRA_PORTS"`
+	// MaxPendingConnections is the maximum number of connections
+	// that wait for the application to wake up, and
+	// MaxWakeWaitSeconds is how long each one waits at most.
+	// Connections over either limit are reset, or answered with
+	// 503 Service Unavailable in HTTP mode. Both are optional,
+	// and zero means no limit, see WakeQueue.
+	MaxPendingConnections int `yaml:"max_pending_connections" env:"MAX_PENDING_CONNECTIONS" validate:"min=0"`
+	MaxWakeWaitSeconds    int `yaml:"max_wake_wait_seconds" env:"MAX_WAKE_WAIT_SECONDS" validate:"min=0"`
+	// Protocol is the protocol proxied from ListenPort to
+	// CommandPort, either "tcp" or "udp". It defaults to "tcp".
+	Protocol string `yaml:"protocol" env:"PROTOCOL" validate:"regexp=^(tcp|udp)$"`
+	// UDPSessionTimeoutSeconds is how long a UDP client may go
+	// without sending or receiving any datagrams before its
+	// session is forgotten. It defaults to 60. Unused for TCP.
+	UDPSessionTimeoutSeconds int `yaml:"udp_session_timeout_seconds" env:"UDP_SESSION_TIMEOUT_SECONDS" validate:"min=1"`
+	// HalfClose makes sleepingd pass on the shutdown of one
+	// direction of a TCP connection (see shutdown(2)) to the
+	// other side, and close the connection only once both
+	// directions are finished, for protocols where the client
+	// half-closes the connection after sending its request. By
+	// default, the connection is closed as soon as either side
+	// stops sending, so that clients which reuse connections
+	// notice when Command is done with one. In HTTP mode, it only
+	// applies to ExtraPorts. Cannot be used with UDP.
+	HalfClose bool `yaml:"half_close" env:"HALF_CLOSE"`
+	// ConnectionIdleTimeoutSeconds closes a TCP connection if no
+	// data is copied in either direction for that long,
+	// ConnectionWriteTimeoutSeconds closes it if writing data to
+	// either side takes longer than that, and
+	// ConnectionMaxAgeSeconds closes it once it has been open for
+	// that long. All are optional, and zero means no limit. In
+	// HTTP mode, the idle timeout only applies between requests,
+	// and the write timeout limits how long each response may
+	// take. TCPKeepAliveSeconds is the period of TCP keepalive
+	// probes on connections from clients and to Command. It
+	// defaults to 0, meaning 15 seconds, and -1 disables them. In
+	// HTTP mode, it only applies to ExtraPorts. None can be used
+	// with UDP.
+	ConnectionIdleTimeoutSeconds  int `yaml:"connection_idle_timeout_seconds" env:"CONNECTION_IDLE_TIMEOUT_SECONDS" validate:"min=0"`
+	ConnectionWriteTimeoutSeconds int `yaml:"connection_write_timeout_seconds" env:"CONNECTION_WRITE_TIMEOUT_SECONDS" validate:"min=0"`
+	ConnectionMaxAgeSeconds       int `yaml:"connection_max_age_seconds" env:"CONNECTION_MAX_AGE_SECONDS" validate:"min=0"`
+	TCPKeepAliveSeconds           int `yaml:"tcp_keepalive_seconds" env:"TCP_KEEPALIVE_SECONDS" validate:"min=-1"`
+	// WakeOnConnect makes sleepingd wake Command and connect to
+	// it as soon as a TCP connection arrives, rather than once
+	// the client sends data, for protocols where the server
+	// speaks first, like SMTP or SSH. If
+	// WakeOnConnectGraceMilliseconds is set, then it waits that
+	// long first, so that connections which are closed again
+	// right away, e.g. by `nc -z`, still do not wake Command. It
+	// cannot be used with UDP, HTTP mode, handoff mode, or
+	// hostnames, but see also PortMapping.WakeOnConnect.
+	WakeOnConnect                  bool `yaml:"wake_on_connect" env:"WAKE_ON_CONNECT"`
+	WakeOnConnectGraceMilliseconds int  `yaml:"wake_on_connect_grace_milliseconds" env:"WAKE_ON_CONNECT_GRACE_MILLISECONDS" validate:"min=0"`
+	// DialAttempts is how many times to try connecting to
+	// Command for each TCP connection, before giving up and
+	// closing the client connection (or responding with 502 Bad
+	// Gateway in HTTP mode). It defaults to 5. The first
+	// retry happens after DialBackoffMilliseconds (default 100),
+	// and each further one after twice as long as the previous
+	// one, but only until DialTimeoutSeconds (default 10) have
+	// passed since the first attempt. If Command has exited in
+	// the meantime, it is started again before retrying.
+	DialAttempts            int `yaml:"dial_attempts" env:"DIAL_ATTEMPTS" validate:"min=1"`
+	DialBackoffMilliseconds int `yaml:"dial_backoff_milliseconds" env:"DIAL_BACKOFF_MILLISECONDS" validate:"min=1"`
+	DialTimeoutSeconds      int `yaml:"dial_timeout_seconds" env:"DIAL_TIMEOUT_SECONDS" validate:"min=1"`
+	// ConnectFrom, WakeFrom, and KeepAwakeFrom restrict which
+	// clients may connect at all, which may wake Command while it
+	// is asleep, and whose traffic keeps it awake, respectively,
+	// see ParseClientRules for the format. Clients that may not
+	// connect are reset (or answered with 403 Forbidden in HTTP
+	// mode), clients that may not wake Command are treated the
+	// same while it is asleep (or answered with 503 Service
+	// Unavailable in HTTP mode), and UDP datagrams are dropped.
+	// All are optional, and by default all clients are allowed.
+	// They apply to ExtraPorts too, unless overridden there, and
+	// cannot be used in handoff mode, since Command accepts
+	// connections itself then.
+	ConnectFrom   []string `yaml:"connect_from" env:"CONNECT_FROM"`
+	WakeFrom      []string `yaml:"wake_from" env:"WAKE_FROM"`
+	KeepAwakeFrom []string `yaml:"keep_awake_from" env:"KEEP_AWAKE_FROM"`
+	// SendProxyProtocol is the version of the PROXY protocol
+	// header, "v1" or "v2", to send to Command at the start of
+	// each connection, so that it can see the address of the
+	// original client. No header is sent by default.
+	// AcceptProxyProtocol makes sleepingd expect a PROXY protocol
+	// header (either version) on each incoming connection, e.g.
+	// from a load balancer, so that the original address can be
+	// passed on. Neither can be used with UDP.
+	SendProxyProtocol   string `yaml:"send_proxy_protocol" env:"SEND_PROXY_PROTOCOL" validate:"regexp=^(v1|v2)?$"`
+	AcceptProxyProtocol bool   `yaml:"accept_proxy_protocol" env:"ACCEPT_PROXY_PROTOCOL"`
+	// TLSCertFile and TLSKeyFile enable TLS termination on the
+	// listener if set, in which case Command receives plaintext.
+	// The files are loaded again whenever they change.
+	// TLSMinVersion is the minimum TLS version, and defaults to
+	// "1.2". TLSALPN lists the protocols to offer with ALPN, e.g.
+	// "h2,http/1.1", and defaults to none in raw mode, or to
+	// "h2,http/1.1" in HTTP mode.
+	TLSCertFile   string   `yaml:"tls_cert_file" env:"TLS_CERT_FILE"`
+	TLSKeyFile    string   `yaml:"tls_key_file" env:"TLS_KEY_FILE"`
+	TLSMinVersion string   `yaml:"tls_min_version" env:"TLS_MIN_VERSION" validate:"regexp=^1\\.[0-3]$"`
+	TLSALPN       []string `yaml:"tls_alpn" env:"TLS_ALPN"`
+	// Hostnames lists the hostnames that the application serves,
+	// matched against the TLS server name (SNI) or HTTP Host
+	// header of each connection, see ListenRouted. DefaultRoute
+	// makes the application receive the connections that do not
+	// match any other application on the same listen address.
+	// Setting either one allows several applications to share a
+	// listen address.
+	Hostnames    []string `yaml:"hostnames" env:"HOSTNAMES"`
+	DefaultRoute bool     `yaml:"default_route" env:"DEFAULT_ROUTE"`
+	// Mode is either "raw", to proxy bytes without looking at
+	// them, "http", to proxy HTTP requests individually, or
+	// "handoff", to pass the listening socket to Command when a
+	// connection arrives (see ProxyOptions.Handoff). It defaults
+	// to "raw". In handoff mode, Command must be in exec form and
+	// support socket activation (see sd_listen_fds(3)), and it is
+	// responsible for exiting once it is idle, so TimeoutSeconds
+	// and CommandPort are not used. In HTTP mode, requests that
+	// arrive while the application is asleep or starting are
+	// held for up to HTTPWakeTimeoutSeconds if HTTPWakeResponse
+	// is "hold", or answered immediately if it is "immediate".
+	// Either way, if the application is not ready then the
+	// client gets 503 Service Unavailable with a Retry-After
+	// header of HTTPRetryAfterSeconds, and browsers are shown the
+	// HTML page at the path HTTPWakingPage (or a default page).
+	Mode                   string `yaml:"mode" env:"MODE" validate:"regexp=^(raw|http|handoff)$"`
+	HTTPWakeResponse       string `yaml:"http_wake_response" env:"HTTP_WAKE_RESPONSE" validate:"regexp=^(hold|immediate)$"`
+	HTTPWakeTimeoutSeconds int    `yaml:"http_wake_timeout_seconds" env:"HTTP_WAKE_TIMEOUT_SECONDS" validate:"min=1"`
+	HTTPRetryAfterSeconds  int    `yaml:"http_retry_after_seconds" env:"HTTP_RETRY_AFTER_SECONDS" validate:"min=1"`
+	HTTPWakingPage         string `yaml:"http_waking_page" env:"HTTP_WAKING_PAGE"`
+	// HealthChecks lists requests in HTTP mode, in the format
+	// "/path" or "METHOD /path", that never wake the application
+	// or keep it awake, optional. While the application is
+	// asleep, they are answered with HealthCheckStatus (default
+	// 200) and HealthCheckBody (default "ok").
+	HealthChecks      []string `yaml:"health_checks" env:"HEALTH_CHECKS"`
+	HealthCheckStatus int      `yaml:"health_check_status" env:"HEALTH_CHECK_STATUS" validate:"min=100,max=599"`
+	HealthCheckBody   string   `yaml:"health_check_body" env:"HEALTH_CHECK_BODY"`
 }
 
-func Main(opts *Options) error {
+// checkOptions validates opts, returning an error if they are
+// invalid. Since options are expected to be validated by LoadConfig
+// before being passed to Main, this should not normally fail.
+func checkOptions(opts *Options) error {
 	if err := validator.Validate(opts); err != nil {
 		return fmt.Errorf("internal logic error: failed struct validation: %v", err)
 	}
-	if opts.MetricsPort != 0 {
-		mux := http.NewServeMux()
-		mux.HandleFunc("/debug/pprof/", pprof.Index)
-		mux.Handle("/metrics", promhttp.Handler())
-		go http.ListenAndServe(fmt.Sprintf("%s:%d", opts.MetricsHost, opts.MetricsPort), mux)
-		fmt.Fprintf(
-			os.Stderr,
-			"sleepingd: pprof and prometheus metrics on %s:%d\n",
-			opts.MetricsHost, opts.MetricsPort,
-		)
-	}
-	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", opts.CommandPort))
-	if err == nil {
-		_ = conn.Close()
-		// Command is already running somewhere else? This
-		// will screw things up, abort.
-		return fmt.Errorf("something is already listening on 127.0.0.1:%d", opts.CommandPort)
-	}
-	shell, err := loginshell.Shell()
+	names := map[string]bool{}
+	commandPorts := map[string]string{}
+	for _, appOpts := range opts.Apps {
+		if names[appOpts.Name] {
+			return fmt.Errorf("duplicate application name: %s", appOpts.Name)
+		}
+		names[appOpts.Name] = true
+		if appOpts.Mode == "handoff" {
+			continue
+		}
+		// TCP and UDP ports are separate, so they
+		// do not conflict with each other.
+		key := fmt.Sprintf("%s/%s", appOpts.Protocol, net.JoinHostPort(appOpts.CommandHost, strconv.Itoa(appOpts.CommandPort)))
+		if appOpts.CommandSocket != "" {
+			key = "unix/" + appOpts.CommandSocket
+		}
+		if other, ok := commandPorts[key]; ok {
+			return fmt.Errorf("applications %s and %s both use command %s", other, appOpts.Name, describeAddr(appOpts.upstreamAddr()))
+		}
+		commandPorts[key] = appOpts.Name
+		for _, m := range appOpts.ExtraPorts {
+			key := fmt.Sprintf("%s/%s", appOpts.Protocol, net.JoinHostPort(appOpts.CommandHost, strconv.Itoa(m.CommandPort)))
+			if other, ok := commandPorts[key]; ok && other != appOpts.Name {
+				return fmt.Errorf("applications %s and %s both use command port %d", other, appOpts.Name, m.CommandPort)
+			}
+			commandPorts[key] = appOpts.Name
+		}
+	}
+	return nil
+}
+
+// daemon tracks the state of everything started by Main, so that it
+// can be reconfigured or shut down.
+type daemon struct {
+	opts    *Options
+	metrics *http.Server
+	control *ControlServer
+
+	// lock must be held to access apps from outside the main
+	// goroutine.
+	lock sync.Mutex
+	apps []*App
+}
+
+func (d *daemon) startMetrics() {
+	if d.opts.MetricsPort == 0 {
+		d.metrics = nil
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.Handle("/metrics", promhttp.Handler())
+	d.metrics = &http.Server{
+		Addr:    net.JoinHostPort(d.opts.MetricsHost, strconv.Itoa(d.opts.MetricsPort)),
+		Handler: mux,
+	}
+	go d.metrics.ListenAndServe()
+	fmt.Fprintf(os.Stderr, "sleepingd: pprof and prometheus metrics on %s\n", d.metrics.Addr)
+}
+
+func (d *daemon) startControl() {
+	d.control = nil
+	if d.opts.ControlSocket == "" {
+		return
+	}
+	control, err := NewControlServer(d.opts.ControlSocket, d.handleControl)
 	if err != nil {
-		return err
+		LogError(fmt.Errorf("failed to start control socket: %w", err))
+		return
+	}
+	d.control = control
+	Log("control socket on %s", d.opts.ControlSocket)
+}
+
+func (d *daemon) handleControl(req *ControlRequest) *ControlResponse {
+	d.lock.Lock()
+	apps := []*App{}
+	for _, app := range d.apps {
+		if req.App == "" || app.Name() == req.App {
+			apps = append(apps, app)
+		}
 	}
-	proc := &SubprocessManager{
-		Command:                []string{shell, "-c", opts.Command},
-		TerminationGracePeriod: 5 * time.Second,
-		EnsureListeningTimeout: 5 * time.Second,
-	}
-	lock := sync.Mutex{}
-	expiryCallback := func() {
-		lock.Lock()
-		defer lock.Unlock()
-		Must(proc.EnsureStopped())
-		Must(proc.EnsureNotListening(opts.CommandPort))
-	}
-	dms := NewDeadMansSwitch(time.Duration(opts.TimeoutSeconds)*time.Second, 1*time.Second, expiryCallback)
-	newConnCallback := func() {
-		lock.Lock()
-		defer lock.Unlock()
-		Must(proc.EnsureStarted())
-		Must(proc.EnsureListening(opts.CommandPort))
-		dms.Ping()
-	}
-	proxy, err := NewProxy(&ProxyOptions{
-		Protocol:              "tcp",
-		ListenAddr:            fmt.Sprintf("%s:%d", opts.ListenHost, opts.ListenPort),
-		UpstreamAddr:          fmt.Sprintf("127.0.0.1:%d", opts.CommandPort),
-		NewConnectionCallback: newConnCallback,
-		DataCallback:          dms.Ping,
+	d.lock.Unlock()
+	if len(apps) == 0 {
+		return &ControlResponse{Error: fmt.Sprintf("no such application: %s", req.App)}
+	}
+	if req.Command != "status" && len(apps) > 1 {
+		return &ControlResponse{Error: "more than one application is configured, please specify which one"}
+	}
+	res := &ControlResponse{}
+	for _, app := range apps {
+		var err error
+		switch req.Command {
+		case "status":
+		case "wake":
+			err = app.ForceWake()
+		case "sleep":
+			err = app.ForceSleep()
+		case "pause":
+			app.Pause()
+		case "resume":
+			app.Resume()
+		default:
+			return &ControlResponse{Error: fmt.Sprintf("unknown command: %s", req.Command)}
+		}
+		if err != nil {
+			return &ControlResponse{Error: err.Error()}
+		}
+		res.Apps = append(res.Apps, app.Status())
+	}
+	return res
+}
+
+var (
+	draining = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sleepingd_draining",
+		Help: "Whether sleepingd is waiting for connections to finish before exiting (1) or not (0).",
 	})
-	if err != nil {
+	drainConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sleepingd_drain_connections",
+		Help: "Number of connections that sleepingd is waiting for to finish before exiting.",
+	}, []string{"app"})
+)
+
+// drain stops all applications gracefully, see App.Drain, waiting
+// for up to the drain timeout. If another SIGINT or SIGTERM arrives
+// on interruptCh in the meantime, then the applications are stopped
+// right away instead.
+func (d *daemon) drain(interruptCh <-chan os.Signal) {
+	timeout := time.Duration(d.opts.DrainTimeoutSeconds) * time.Second
+	Log("waiting up to %s for connections to finish before exiting, send the signal again to exit now", timeout)
+	draining.Set(1)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		wg := sync.WaitGroup{}
+		for _, app := range d.apps {
+			wg.Go(func() {
+				LogError(app.Drain(ctx))
+			})
+		}
+		wg.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case interrupt := <-interruptCh:
+			if interrupt == syscall.SIGHUP {
+				Log("ignoring SIGHUP while exiting")
+				continue
+			}
+			Log("exiting without waiting for connections to finish")
+			cancel()
+			<-done
+			return
+		}
+	}
+}
+
+// closeApps stops all the given applications in parallel, so that
+// their termination grace periods overlap.
+func closeApps(apps []*App) {
+	wg := sync.WaitGroup{}
+	for _, app := range apps {
+		wg.Go(func() {
+			LogError(app.Close())
+		})
+	}
+	wg.Wait()
+}
+
+// reconfigure applies opts to the running daemon. Applications that
+// are no longer configured are stopped, new ones are started, and
+// the rest are reconfigured in place, see App.Reconfigure. If
+// reconfiguring an application fails, it keeps running with its
+// previous options.
+func (d *daemon) reconfigure(opts *Options) error {
+	if err := checkOptions(opts); err != nil {
+		return err
+	}
+	configured := map[string]bool{}
+	for _, appOpts := range opts.Apps {
+		configured[appOpts.Name] = true
+	}
+	existing := map[string]*App{}
+	removed := []*App{}
+	for _, app := range d.apps {
+		if configured[app.Name()] {
+			existing[app.Name()] = app
+		} else {
+			app.log("removed from configuration")
+			removed = append(removed, app)
+		}
+	}
+	// Stop removed applications and close changed listeners
+	// first, in case new ones want to use the same ports, e.g.
+	// when two applications swap ports.
+	closeApps(removed)
+	for _, appOpts := range opts.Apps {
+		if app, ok := existing[appOpts.Name]; ok {
+			app.CloseChangedListeners(appOpts)
+		}
+	}
+	apps := []*App{}
+	for _, appOpts := range opts.Apps {
+		if app, ok := existing[appOpts.Name]; ok {
+			LogError(app.Reconfigure(appOpts))
+			apps = append(apps, app)
+			continue
+		}
+		app, err := NewApp(appOpts)
+		if err != nil {
+			LogError(err)
+			continue
+		}
+		apps = append(apps, app)
+	}
+	d.lock.Lock()
+	d.apps = apps
+	d.lock.Unlock()
+	metricsChanged := opts.MetricsHost != d.opts.MetricsHost || opts.MetricsPort != d.opts.MetricsPort
+	controlChanged := opts.ControlSocket != d.opts.ControlSocket
+	d.opts = opts
+	if metricsChanged {
+		if d.metrics != nil {
+			LogError(d.metrics.Close())
+		}
+		d.startMetrics()
+	}
+	if controlChanged {
+		if d.control != nil {
+			LogError(d.control.Close())
+		}
+		d.startControl()
+	}
+	return nil
+}
+
+// Main runs sleepingd with the given options until it receives
+// SIGINT or SIGTERM, after which connections in progress are given
+// time to finish, see Options.DrainTimeoutSeconds. If reload is
+// non-nil, then it is called upon receipt of SIGHUP to get new
+// options, which are applied without restarting anything that has
+// not changed.
+func Main(opts *Options, reload func() (*Options, error)) error {
+	if err := checkOptions(opts); err != nil {
 		return err
 	}
-	fmt.Fprintf(os.Stderr, "sleepingd: listening on %s:%d, proxying to 127.0.0.1:%d with %s command line: %s\n", opts.ListenHost, opts.ListenPort, opts.CommandPort, shell, opts.Command)
+	d := &daemon{
+		opts: opts,
+	}
+	d.startMetrics()
+	for _, appOpts := range opts.Apps {
+		app, err := NewApp(appOpts)
+		if err != nil {
+			closeApps(d.apps)
+			return err
+		}
+		d.apps = append(d.apps, app)
+	}
+	d.startControl()
 	interruptCh := make(chan os.Signal, 1)
-	signal.Notify(interruptCh, syscall.SIGINT, syscall.SIGTERM)
-	interrupt := <-interruptCh
-	LogError(proxy.Close())
-	LogError(proc.EnsureStopped())
-	os.Exit(128 + int(interrupt.(syscall.Signal)))
-	panic("unreachable code")
+	signal.Notify(interruptCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		interrupt := <-interruptCh
+		if interrupt != syscall.SIGHUP {
+			if d.control != nil {
+				LogError(d.control.Close())
+			}
+			d.drain(interruptCh)
+			os.Exit(128 + int(interrupt.(syscall.Signal)))
+		}
+		if reload == nil {
+			Log("ignoring SIGHUP, configuration cannot be reloaded")
+			continue
+		}
+		Log("reloading configuration")
+		newOpts, err := reload()
+		if err == nil {
+			err = d.reconfigure(newOpts)
+		}
+		if err != nil {
+			Log("error: failed to reload configuration, keeping previous configuration: %s", err.Error())
+		}
+	}
 }
@@ -0,0 +1,110 @@
+package sleepingd
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PortMapping is an additional port that an application listens on,
+// see AppOptions.ExtraPorts. Traffic to ListenPort is proxied to
+// CommandPort. Unless Optional is set, the application is not
+// considered ready until it is listening on CommandPort.
+// WakeOnConnect is the same as AppOptions.WakeOnConnect, but for
+// ListenPort. ConnectFrom, WakeFrom, and KeepAwakeFrom replace the
+// ones in AppOptions for ListenPort if they are not nil, so e.g. an
+// admin port can be restricted to a VPN while the main port is
+// public. They can only be set in a configuration file.
+type PortMapping struct {
+	ListenPort    int      `yaml:"listen_port"`
+	CommandPort   int      `yaml:"command_port"`
+	Optional      bool     `yaml:"optional"`
+	WakeOnConnect bool     `yaml:"wake_on_connect"`
+	ConnectFrom   []string `yaml:"connect_from"`
+	WakeFrom      []string `yaml:"wake_from"`
+	KeepAwakeFrom []string `yaml:"keep_awake_from"`
+}
+
+// equal reports whether m and other are the same mapping.
+func (m PortMapping) equal(other PortMapping) bool {
+	return m.ListenPort == other.ListenPort &&
+		m.CommandPort == other.CommandPort &&
+		m.Optional == other.Optional &&
+		m.WakeOnConnect == other.WakeOnConnect &&
+		equalRules(m.ConnectFrom, other.ConnectFrom) &&
+		equalRules(m.WakeFrom, other.WakeFrom) &&
+		equalRules(m.KeepAwakeFrom, other.KeepAwakeFrom)
+}
+
+// equalRules is like slices.Equal, except that nil rules (inherited
+// from the application) differ from empty ones (allowing everyone).
+func equalRules(a []string, b []string) bool {
+	return (a == nil) == (b == nil) && slices.Equal(a, b)
+}
+
+// UnmarshalText parses a port mapping from an environment variable,
+// in the format "LISTEN:COMMAND", optionally followed by ":optional"
+// and/or ":wake_on_connect".
+func (m *PortMapping) UnmarshalText(text []byte) error {
+	parts := strings.Split(string(text), ":")
+	for len(parts) > 2 {
+		switch parts[len(parts)-1] {
+		case "optional":
+			m.Optional = true
+		case "wake_on_connect":
+			m.WakeOnConnect = true
+		default:
+			return fmt.Errorf("invalid port mapping %q, unknown flag %q", string(text), parts[len(parts)-1])
+		}
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid port mapping %q, expected LISTEN:COMMAND, optionally followed by :optional or :wake_on_connect", string(text))
+	}
+	listenPort, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return fmt.Errorf("invalid listen port in port mapping %q", string(text))
+	}
+	commandPort, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid command port in port mapping %q", string(text))
+	}
+	m.ListenPort = listenPort
+	m.CommandPort = commandPort
+	return nil
+}
+
+// UnmarshalYAML parses a port mapping from a configuration file,
+// either as a string in the same format as for UnmarshalText, or as a
+// mapping with the keys in the yaml tags of PortMapping. Unknown keys
+// are rejected, like elsewhere in the configuration file.
+func (m *PortMapping) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return m.UnmarshalText([]byte(value.Value))
+	}
+	if value.Kind == yaml.MappingNode {
+		// value.Decode does not know whether the outer
+		// decoder has KnownFields set, so check by hand.
+		known := map[string]bool{}
+		typ := reflect.TypeOf(*m)
+		for i := range typ.NumField() {
+			known[strings.Split(typ.Field(i).Tag.Get("yaml"), ",")[0]] = true
+		}
+		unknown := []string{}
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			if key := value.Content[i]; !known[key.Value] {
+				unknown = append(unknown, fmt.Sprintf("line %d: field %s not found in type %s", key.Line, key.Value, typ))
+			}
+		}
+		if len(unknown) > 0 {
+			return &yaml.TypeError{Errors: unknown}
+		}
+	}
+	// Avoid recursing into this method.
+	type plain PortMapping
+	return value.Decode((*plain)(m))
+}
@@ -1,145 +1,708 @@
 package sleepingd
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ProxyOptions is used to configure NewProxy, which see for
-// documentation. All fields are required except
-// NewConnectionCallback.
+// documentation. Protocol, ListenAddr, and UpstreamAddr are required,
+// and all other fields are optional.
 type ProxyOptions struct {
-	// Protocol is either "tcp" or "udp"
+	// Protocol is "tcp", "udp", or "unix" (for a Unix domain
+	// socket), and is used for the listener
 	Protocol string
 	// ListenAddr is the address the proxy server will listen for
-	// incoming TCP/UDP traffic on, e.g. "127.0.0.1:80"
+	// incoming TCP/UDP traffic on, e.g. "127.0.0.1:80", or the
+	// path of the socket for Unix domain sockets
 	ListenAddr string
+	// UpstreamProtocol is the protocol used to connect to the
+	// upstream address. It defaults to Protocol. TCP and Unix
+	// domain sockets can be mixed freely, but UDP can only be
+	// proxied to UDP.
+	UpstreamProtocol string
 	// UpstreamAddr is the upstream address the proxy will proxy
-	// TCP/UDP traffic to, e.g. "127.0.0.1:8080"
+	// TCP/UDP traffic to, e.g. "127.0.0.1:8080", or the path of
+	// a Unix domain socket
 	UpstreamAddr string
+	// SocketMode and SocketOwner set the permissions and
+	// ownership of the listening socket if Protocol is "unix",
+	// see listenUnix. By default they are left alone.
+	SocketMode  os.FileMode
+	SocketOwner string
+	// Listener is used to accept connections instead of
+	// listening on ListenAddr, optional, e.g. a listener returned
+	// by ListenRouted or ActivationListener. PacketConn is the
+	// same for UDP. The proxy takes ownership of them. SocketMode
+	// and SocketOwner are not applied to them.
+	Listener   net.Listener
+	PacketConn net.PacketConn
 	// NewConnectionCallback is a function of no arguments,
 	// optional. If provided, then it is called synchronously when
 	// a new connection is accepted and some data has been
 	// received from the client, but before the data is proxied to
 	// the upstream address. This could be used to track metrics
 	// on incoming connections, or to ensure that the upstream is
-	// available before traffic is proxied to it.
-	NewConnectionCallback func()
+	// available before traffic is proxied to it. If it returns an
+	// error, then the connection is reset (or answered with 503
+	// Service Unavailable in HTTP mode), and the error is not
+	// logged, so the callback should log it itself.
+	NewConnectionCallback func() error
+	// ReadyCallback is a function of no arguments, optional. If
+	// provided, then it should report whether the upstream is
+	// ready to receive traffic without waiting. It is used in
+	// HTTP mode to decide whether requests should be held or
+	// answered while NewConnectionCallback runs.
+	ReadyCallback func() bool
+	// WakeQueue limits how many connections wait for
+	// NewConnectionCallback while the upstream is not ready, and
+	// for how long, optional. Connections over the limit are
+	// reset, or answered with 503 Service Unavailable in HTTP
+	// mode, and UDP sessions are dropped. It may be shared
+	// between proxies for the same upstream.
+	WakeQueue *WakeQueue
 	// DataCallback is a function of no arguments, optional. If
 	// provided, then it is called synchronously when data is to
 	// be copied either to or from the backend server. This could
 	// be used to track metrics on network activity.
 	DataCallback func()
+	// SessionTimeout is how long a UDP session may go without
+	// any datagrams in either direction before it is forgotten,
+	// optional. Defaults to DefaultUDPSessionTimeout. Unused for
+	// TCP.
+	SessionTimeout time.Duration
+	// SessionBuffer is the maximum number of datagrams from a
+	// client that are held while the upstream is being woken up,
+	// optional. Further datagrams are dropped. Defaults to
+	// DefaultUDPSessionBuffer. Unused for TCP.
+	SessionBuffer int
+	// SendProxyHeader is the version of the PROXY protocol
+	// header (1 or 2) to send at the start of each connection to
+	// the upstream, so that it can see the address of the
+	// original client, optional. It defaults to 0, meaning no
+	// header is sent. Not supported for UDP.
+	SendProxyHeader int
+	// AcceptProxyHeader makes the listener expect a PROXY
+	// protocol header (either version) at the start of each
+	// connection, e.g. from a load balancer, optional. The
+	// addresses in the header are used in place of the real
+	// addresses of the connection. Not supported for UDP.
+	AcceptProxyHeader bool
+	// HalfClose makes the proxy pass on EOF from either side of a
+	// TCP connection by shutting down writing to the other side,
+	// and close the connection only once both directions are
+	// finished, optional. By default, the connection is closed as
+	// soon as either side stops sending. Not supported for UDP.
+	HalfClose bool
+	// IdleTimeout closes a TCP connection if no data is copied in
+	// either direction for that long, optional. WriteTimeout
+	// closes it if writing data to either side takes longer than
+	// that, e.g. because the other end is not reading. MaxAge
+	// closes it once it has been open for that long, whether or
+	// not it is active. All default to 0, meaning no limit. In
+	// HTTP mode, IdleTimeout only applies between requests, and
+	// WriteTimeout limits how long each response may take, see
+	// http.Server. Not supported for UDP.
+	IdleTimeout  time.Duration
+	WriteTimeout time.Duration
+	MaxAge       time.Duration
+	// KeepAlive is the period of TCP keepalive probes on client
+	// and upstream connections, optional. It defaults to 0,
+	// meaning the default of the net package (currently 15
+	// seconds), and a negative value disables keepalive probes.
+	KeepAlive time.Duration
+	// WakeOnConnect makes the proxy connect to the upstream, and
+	// so call NewConnectionCallback, as soon as a TCP connection
+	// is accepted, rather than once the client sends data,
+	// optional. This is for protocols where the server speaks
+	// first. If WakeOnConnectGrace is set, then it waits that
+	// long first, in case the client sends data or closes the
+	// connection in the meantime, so that e.g. port scans do not
+	// wake the upstream. Not supported for UDP or in HTTP mode.
+	WakeOnConnect      bool
+	WakeOnConnectGrace time.Duration
+	// DialAttempts is how many times to try connecting to the
+	// upstream for each TCP connection, optional. It defaults to
+	// 1. The first retry happens after DialBackoff, and each
+	// further one after twice as long as the previous one, but
+	// not after DialTimeout has passed since the first attempt,
+	// if set. Before each retry, the upstream is woken up again,
+	// in case it has died in the meantime.
+	DialAttempts int
+	DialBackoff  time.Duration
+	DialTimeout  time.Duration
+	// ConnectFrom, WakeFrom, and KeepAwakeFrom decide, based on
+	// the address of the client, whether it may connect at all,
+	// whether it may call NewConnectionCallback while the
+	// upstream is not ready (according to ReadyCallback), and
+	// whether its traffic calls DataCallback, respectively, all
+	// optional. By default all clients are allowed. Clients that
+	// may not connect or wake the upstream are reset, or answered
+	// with 403 Forbidden or 503 Service Unavailable respectively
+	// in HTTP mode, and their UDP datagrams are dropped. Not
+	// supported in handoff mode.
+	ConnectFrom   *ClientRules
+	WakeFrom      *ClientRules
+	KeepAwakeFrom *ClientRules
+	// ClosedCallback is a function, optional. If provided, then
+	// it is called with the reason when a TCP connection is
+	// closed, one of the closeReason constants. This could be
+	// used to track metrics on connections.
+	ClosedCallback func(reason string)
+	// TLS enables TLS termination on the listener if set,
+	// optional. Data is proxied to the upstream in plaintext. The
+	// handshake does not wait for the upstream to start. Not
+	// supported for UDP.
+	TLS *tls.Config
+	// HTTP enables HTTP mode if set, optional. Protocol must be
+	// "tcp" or "unix". In HTTP mode, requests are parsed and
+	// proxied individually, rather than copying bytes, so that
+	// clients can be sent a response while the upstream is
+	// starting, see HTTPOptions.
+	HTTP *HTTPOptions
+	// Handoff enables handoff mode if set, optional. Protocol
+	// must be "tcp" or "unix", and TLS and the PROXY protocol
+	// cannot be used. In handoff mode, when a connection arrives,
+	// Handoff is called with the proxy and a copy of the
+	// listening socket. It should start the upstream with the
+	// socket, unless the proxy has been closed in the meantime
+	// (see Proxy.Closed), and return a channel that is closed once
+	// the upstream has exited, or nil if it was not started.
+	// While the upstream is running, it accepts connections from
+	// the socket itself, so the proxy is not involved. The file
+	// is closed after Handoff returns.
+	Handoff func(*Proxy, *os.File) <-chan struct{}
 }
 
 // Proxy is a struct returned by NewProxy, that represents a running
 // proxy server. It can be used to stop the server by calling Close.
 type Proxy struct {
-	listener net.Listener
+	// Exactly one of listener (TCP) and packetConn (UDP) is set.
+	listener   net.Listener
+	packetConn net.PacketConn
+	// server and transports are set in HTTP mode.
+	server     *http.Server
+	transports []*http.Transport
+
+	// active is the number of client connections that are open,
+	// see ActiveConnections.
+	active atomic.Int64
+
+	// lock must be held to access closed, upstreamProtocol,
+	// upstreamAddr, httpOptions, or sessions.
+	lock             sync.Mutex
+	closed           bool
+	upstreamProtocol string
+	upstreamAddr     string
+	httpOptions      *HTTPOptions
+	// sessions maps client addresses to UDP sessions.
+	sessions       map[string]*udpSession
+	sessionTimeout time.Duration
 }
 
 // NewProxy creates and starts a TCP or UDP server that will
 // transparently proxy TCP/UDP traffic to an upstream address, see
 // ProxyOptions for the options. An instance of Proxy is returned
 // which can be used to stop the server later.
+//
+// Since UDP has no connections, datagrams are grouped into sessions
+// by client address. The first datagram from a new client address
+// counts as a new connection, and further datagrams from the same
+// client are buffered until NewConnectionCallback returns. Sessions
+// expire after SessionTimeout without traffic.
+//
+// In HTTP mode (see ProxyOptions.HTTP), each request is handled
+// separately. Requests that arrive while the upstream is not ready
+// start it up, and are then either held until it is ready or
+// answered with 503 Service Unavailable.
+//
+// In handoff mode (see ProxyOptions.Handoff), the listening socket is
+// passed to the upstream when a connection arrives, so that the
+// upstream serves connections directly until it exits. Only the
+// connection that woke it up is proxied.
 func NewProxy(opts *ProxyOptions) (*Proxy, error) {
-	l, err := net.Listen(opts.Protocol, opts.ListenAddr)
+	if opts.Protocol == "udp" {
+		return newUDPProxy(opts)
+	}
+	l := opts.Listener
+	var err error
+	if l != nil {
+		// Already listening
+	} else if opts.Protocol == "unix" {
+		l, err = listenUnix(opts.ListenAddr, opts.SocketMode, opts.SocketOwner)
+	} else {
+		l, err = net.Listen(opts.Protocol, opts.ListenAddr)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if opts.AcceptProxyHeader {
+		l = &proxyHeaderListener{Listener: l}
+	}
+	if opts.TLS != nil {
+		// Handshakes happen on the first read from each
+		// connection, not in Accept.
+		l = tls.NewListener(l, opts.TLS)
+	}
+	if opts.HTTP != nil {
+		return newHTTPProxy(l, opts), nil
+	}
+	if opts.Handoff != nil {
+		return newHandoffProxy(l, opts)
+	}
+	p := &Proxy{
+		listener:         l,
+		upstreamProtocol: opts.upstreamProtocol(),
+		upstreamAddr:     opts.UpstreamAddr,
+	}
 	go func() {
 		for {
 			conn, err := l.Accept()
-			if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// Proxy was closed, stop accepting
+				// connections.
+				return
+			} else if err != nil {
 				continue
 			}
-			go func(c net.Conn) {
-				uc := NewLazyConn(func() (SimpleConn, error) {
-					if opts.NewConnectionCallback != nil {
-						opts.NewConnectionCallback()
-					}
-					uc, err := net.Dial(opts.Protocol, opts.UpstreamAddr)
-					if err != nil {
-						LogError(err)
-						return nil, err
-					}
-					return uc, nil
-					// openOnRead: false
-					// openOnWrite: true
-					//
-					// Only actually open the
-					// connection once client
-					// writes to it.
-				}, false, true)
-				activityCh := make(chan struct{})
-				go func() {
-					for {
-						if _, ok := <-activityCh; !ok {
-							break
-						}
-						if opts.DataCallback != nil {
-							opts.DataCallback()
-						}
-					}
-				}()
-				doneCh := make(chan struct{}, 2)
-				go func() {
-					// Copy request from client to
-					// upstream server. Ignore
-					// errors because they may
-					// indicate that client
-					// disconnected unexpectedly
-					// which is not actionable on
-					// our end.
-					_ = CopyWithActivity(uc, c, activityCh)
-					doneCh <- struct{}{}
-				}()
-				go func() {
-					// Copy response from upstream
-					// server to client. Ignore
-					// errors, as above.
-					_ = CopyWithActivity(c, uc, activityCh)
-					doneCh <- struct{}{}
-				}()
-				// Wait for at least one copy
-				// operation to finish. If the copy
-				// operation finishes it means that
-				// the connection is closed. Just
-				// because all the data is sent on an
-				// http connection, for example, there
-				// is always the possibility of
-				// copying more data later (http/2,
-				// websocket, etc). When the
-				// connection is closed, we should
-				// abort everything.
-				<-doneCh
-				// Once the upstream server closes its
-				// connection or is unable to send
-				// further data, we should proactively
-				// close both it and the client
-				// connection, to indicate to the
-				// sender that more data cannot be
-				// sent on this connection. Otherwise
-				// smart clients such as web browsers
-				// may attempt to reuse it, and hang.
-				_ = uc.Close()
-				_ = c.Close()
-				// Also make sure to close our channel
-				// so the loop goroutine above doesn't
-				// keep spinning forever. We have to
-				// wait for *both* goroutines to exit
-				// here, which should happen promptly
-				// now that we have closed the
-				// connections.
-				<-doneCh
-				close(activityCh)
-			}(conn)
+			go p.serveConn(conn, opts, func() (net.Conn, error) {
+				return p.dialUpstream(conn, opts)
+			})
+		}
+	}()
+	return p, nil
+}
+
+// dialUpstream is called to connect to the upstream for the client
+// connection c, once the client has sent some data.
+func (p *Proxy) dialUpstream(c net.Conn, opts *ProxyOptions) (net.Conn, error) {
+	if err := wakeUpstream(context.Background(), opts, c.RemoteAddr()); err != nil {
+		resetConn(c)
+		return nil, err
+	}
+	uc, err := p.dialWithRetries(context.Background(), c.RemoteAddr(), opts)
+	var wakeErr retryWakeError
+	if errors.As(err, &wakeErr) {
+		resetConn(c)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	if opts.SendProxyHeader != 0 {
+		err := WriteProxyHeader(uc, opts.SendProxyHeader, c.RemoteAddr(), c.LocalAddr())
+		if err != nil {
+			_ = uc.Close()
+			return nil, err
+		}
+	}
+	return uc, nil
+}
+
+// dialWithRetries connects to the upstream on behalf of client,
+// retrying according to opts.DialAttempts, see ProxyOptions. If
+// waking the upstream before a retry fails, then the error is a
+// retryWakeError.
+func (p *Proxy) dialWithRetries(ctx context.Context, client net.Addr, opts *ProxyOptions) (net.Conn, error) {
+	dialer := &net.Dialer{KeepAlive: opts.KeepAlive}
+	var deadline time.Time
+	if opts.DialTimeout > 0 {
+		deadline = time.Now().Add(opts.DialTimeout)
+	}
+	backoff := opts.DialBackoff
+	for attempt := 1; ; attempt++ {
+		// Look up the upstream every time, in case it was
+		// changed by SetUpstream.
+		protocol, addr := p.Upstream()
+		uc, err := dialer.DialContext(ctx, protocol, addr)
+		if err == nil {
+			return uc, nil
+		}
+		if attempt >= opts.DialAttempts || (!deadline.IsZero() && time.Now().Add(backoff).After(deadline)) || p.Closed() || ctx.Err() != nil {
+			if attempt > 1 {
+				err = fmt.Errorf("failed to connect to upstream after %d attempts: %w", attempt, err)
+			}
+			return nil, err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+		if err := wakeUpstream(ctx, opts, client); err != nil {
+			return nil, retryWakeError{err}
+		}
+	}
+}
+
+// retryWakeError wraps errors from wakeUpstream between dial
+// attempts, see dialWithRetries.
+type retryWakeError struct {
+	err error
+}
+
+func (e retryWakeError) Error() string {
+	return e.err.Error()
+}
+
+func (e retryWakeError) Unwrap() error {
+	return e.err
+}
+
+// errWakeFailed wraps errors returned by
+// ProxyOptions.NewConnectionCallback, which are not logged again.
+var errWakeFailed = errors.New("failed to wake the upstream")
+
+// wakeUpstream calls opts.NewConnectionCallback, if any, through
+// opts.WakeQueue unless the upstream is already ready. If it is not
+// ready and opts.WakeFrom does not allow client, then
+// errWakeDenied is returned instead.
+func wakeUpstream(ctx context.Context, opts *ProxyOptions, client net.Addr) error {
+	if opts.NewConnectionCallback == nil {
+		return nil
+	}
+	wake := func() error {
+		if err := opts.NewConnectionCallback(); err != nil {
+			return fmt.Errorf("%w: %w", errWakeFailed, err)
+		}
+		return nil
+	}
+	if opts.ReadyCallback != nil && opts.ReadyCallback() {
+		return wake()
+	}
+	if !opts.WakeFrom.Allows(client) {
+		return errWakeDenied
+	}
+	return opts.WakeQueue.Wake(ctx, wake)
+}
+
+// wakeErrorIsExpected reports whether err from wakeUpstream does not
+// need to be logged, either because it has been logged already,
+// because it is not actionable, or because it is counted by the
+// metrics of the WakeQueue instead, which avoids flooding the log
+// during a burst of connections.
+func wakeErrorIsExpected(err error) bool {
+	return errors.Is(err, errWakeFailed) ||
+		errors.Is(err, errWakeDenied) ||
+		errors.Is(err, errWakeQueueFull) ||
+		errors.Is(err, errWakeTimeout)
+}
+
+// underlyingTCPConn returns the TCP connection that c wraps, or nil
+// if it is not a TCP connection.
+func underlyingTCPConn(c net.Conn) *net.TCPConn {
+	for {
+		switch conn := c.(type) {
+		case *net.TCPConn:
+			return conn
+		case *tls.Conn:
+			c = conn.NetConn()
+		case *proxyHeaderConn:
+			c = conn.Conn
+		case *peekedConn:
+			c = conn.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// resetConn makes closing c reset the connection, rather than
+// closing it gracefully, so that the client can tell that it was
+// rejected.
+func resetConn(c net.Conn) {
+	if tc := underlyingTCPConn(c); tc != nil {
+		_ = tc.SetLinger(0)
+	}
+}
+
+// setKeepAlive applies ProxyOptions.KeepAlive to c, if it is a TCP
+// connection.
+func setKeepAlive(c net.Conn, period time.Duration) {
+	tc := underlyingTCPConn(c)
+	if tc == nil || period == 0 {
+		return
+	}
+	if period < 0 {
+		_ = tc.SetKeepAlive(false)
+		return
+	}
+	_ = tc.SetKeepAlive(true)
+	_ = tc.SetKeepAlivePeriod(period)
+}
+
+// closeWrite shuts down writing to c, if it supports that, so that
+// the other end sees EOF but can still send data.
+func closeWrite(c any) error {
+	for {
+		switch conn := c.(type) {
+		case interface{ CloseWrite() error }:
+			return conn.CloseWrite()
+		case *proxyHeaderConn:
+			c = conn.Conn
+		case *peekedConn:
+			c = conn.Conn
+		default:
+			return fmt.Errorf("half-close not supported for %T", c)
 		}
+	}
+}
+
+// Reasons for closing a connection, passed to
+// ProxyOptions.ClosedCallback.
+const (
+	closeReasonClient       = "client"
+	closeReasonUpstream     = "upstream"
+	closeReasonError        = "error"
+	closeReasonIdleTimeout  = "idle_timeout"
+	closeReasonWriteTimeout = "write_timeout"
+	closeReasonMaxAge       = "max_age"
+	closeReasonDenied       = "denied"
+)
+
+// copyResult is the outcome of copying one direction of a
+// connection in serveConn.
+type copyResult struct {
+	err    error
+	reason string
+}
+
+// copyDirection copies data from src to dst for serveConn, and
+// returns the result. If src reaches EOF, then the reason is
+// eofReason.
+func copyDirection(dst io.Writer, src io.Reader, activityCh chan<- struct{}, opts *ProxyOptions, eofReason string) copyResult {
+	// Splicing must report activity often enough that the idle
+	// timeout does not expire in between.
+	activityInterval := spliceActivityInterval
+	if opts.IdleTimeout > 0 {
+		activityInterval = min(activityInterval, opts.IdleTimeout/4)
+	}
+	err := copyWithActivity(dst, src, activityCh, opts.WriteTimeout, activityInterval)
+	if err == nil && opts.HalfClose {
+		err = closeWrite(dst)
+	}
+	switch {
+	case err == nil:
+		return copyResult{reason: eofReason}
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return copyResult{err: err, reason: closeReasonWriteTimeout}
+	case errors.Is(err, errWakeDenied):
+		return copyResult{err: err, reason: closeReasonDenied}
+	default:
+		return copyResult{err: err, reason: closeReasonError}
+	}
+}
+
+// serveConn proxies data between the client connection c and the
+// connection returned by dial, until either side closes its
+// connection, or one of the timeouts in opts expires.
+func (p *Proxy) serveConn(c net.Conn, opts *ProxyOptions, dial func() (net.Conn, error)) {
+	p.active.Add(1)
+	defer p.active.Add(-1)
+	if !opts.ConnectFrom.Allows(c.RemoteAddr()) {
+		resetConn(c)
+		_ = c.Close()
+		if opts.ClosedCallback != nil {
+			opts.ClosedCallback(closeReasonDenied)
+		}
+		return
+	}
+	keepAwake := opts.KeepAwakeFrom.Allows(c.RemoteAddr())
+	setKeepAlive(c, opts.KeepAlive)
+	uc := NewLazyConn(func() (SimpleConn, error) {
+		uc, err := dial()
+		if err != nil {
+			if !wakeErrorIsExpected(err) {
+				LogError(err)
+			}
+			return nil, err
+		}
+		return uc, nil
+		// openOnRead: false
+		// openOnWrite: true
+		//
+		// Only actually open the connection once the client
+		// writes to it, unless WakeOnConnect is set.
+	}, false, true)
+	if opts.WakeOnConnect {
+		// If the client closes the connection before the
+		// grace period is over, then uc is closed too, and
+		// opening it does nothing.
+		timer := time.AfterFunc(opts.WakeOnConnectGrace, func() {
+			_ = uc.Open()
+		})
+		defer timer.Stop()
+	}
+	// If a timeout expires, the connections are closed, which
+	// makes both copy operations below fail. closeReason is set
+	// beforehand so that the closure is not counted as an error.
+	// Whichever sets it first decides the reason.
+	var closeReason atomic.Pointer[string]
+	timeout := func(reason string) {
+		if closeReason.CompareAndSwap(nil, &reason) {
+			_ = uc.Close()
+			_ = c.Close()
+		}
+	}
+	activityCh := make(chan struct{})
+	go func() {
+		var idle, maxAge <-chan time.Time
+		var idleTimer *time.Timer
+		if opts.IdleTimeout > 0 {
+			idleTimer = time.NewTimer(opts.IdleTimeout)
+			defer idleTimer.Stop()
+			idle = idleTimer.C
+		}
+		if opts.MaxAge > 0 {
+			maxAgeTimer := time.NewTimer(opts.MaxAge)
+			defer maxAgeTimer.Stop()
+			maxAge = maxAgeTimer.C
+		}
+		for {
+			select {
+			case _, ok := <-activityCh:
+				if !ok {
+					return
+				}
+				if opts.DataCallback != nil && keepAwake {
+					opts.DataCallback()
+				}
+				if idleTimer != nil {
+					idleTimer.Reset(opts.IdleTimeout)
+				}
+			case <-idle:
+				timeout(closeReasonIdleTimeout)
+				idle = nil
+			case <-maxAge:
+				timeout(closeReasonMaxAge)
+				maxAge = nil
+			}
+		}
+	}()
+	doneCh := make(chan copyResult, 2)
+	go func() {
+		// Copy request from client to upstream server. Errors
+		// are not logged because they may indicate that client
+		// disconnected unexpectedly which is not actionable
+		// on our end.
+		doneCh <- copyDirection(uc, c, activityCh, opts, closeReasonClient)
 	}()
-	return &Proxy{
-		listener: l,
-	}, nil
+	go func() {
+		// Copy response from upstream server to client.
+		// Errors are not logged, as above.
+		doneCh <- copyDirection(c, uc, activityCh, opts, closeReasonUpstream)
+	}()
+	// Wait for at least one copy operation to finish. If the copy
+	// operation finishes it means that the connection is closed.
+	// Just because all the data is sent on an http connection,
+	// for example, there is always the possibility of copying
+	// more data later (http/2, websocket, etc). When the
+	// connection is closed, we should abort everything.
+	//
+	// The exception is with HalfClose, where a clean EOF has been
+	// passed on to the other side, which may still send a
+	// response, so we wait for that too.
+	remaining := 2
+	res := <-doneCh
+	remaining--
+	if res.err == nil && opts.HalfClose {
+		res = <-doneCh
+		remaining--
+	}
+	closeReason.CompareAndSwap(nil, &res.reason)
+	// Once the upstream server closes its connection or is unable
+	// to send further data, we should proactively close both it
+	// and the client connection, to indicate to the sender that
+	// more data cannot be sent on this connection. Otherwise
+	// smart clients such as web browsers may attempt to reuse it,
+	// and hang.
+	_ = uc.Close()
+	_ = c.Close()
+	// Also make sure to close our channel so the loop goroutine
+	// above doesn't keep spinning forever. We have to wait for
+	// *both* goroutines to exit here, which should happen
+	// promptly now that we have closed the connections.
+	if remaining > 0 {
+		<-doneCh
+	}
+	close(activityCh)
+	if opts.ClosedCallback != nil {
+		opts.ClosedCallback(*closeReason.Load())
+	}
+}
+
+func (opts *ProxyOptions) upstreamProtocol() string {
+	if opts.UpstreamProtocol == "" {
+		return opts.Protocol
+	}
+	return opts.UpstreamProtocol
+}
+
+// Upstream returns the protocol and address that new connections are
+// proxied to.
+func (p *Proxy) Upstream() (string, string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.upstreamProtocol, p.upstreamAddr
 }
 
+// SetUpstream changes the protocol and address that new connections
+// are proxied to. Connections that have already been proxied are not
+// affected.
+func (p *Proxy) SetUpstream(protocol string, addr string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.upstreamProtocol = protocol
+	p.upstreamAddr = addr
+}
+
+// Closed reports whether Close has been called.
+func (p *Proxy) Closed() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.closed
+}
+
+// ActiveConnections returns the number of client connections that
+// are open, including ones accepted before the proxy was closed.
+// UDP sessions are not counted.
+func (p *Proxy) ActiveConnections() int {
+	return int(p.active.Load())
+}
+
+// Close stops accepting new connections. Connections that are in
+// progress are left to finish, see ActiveConnections. Calling Close
+// again does nothing.
 func (p *Proxy) Close() error {
-	return p.listener.Close()
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.lock.Unlock()
+	if p.packetConn != nil {
+		return p.packetConn.Close()
+	}
+	err := p.listener.Close()
+	if p.server != nil {
+		// Stop accepting connections right away, but let
+		// requests that are in flight finish, as for TCP.
+		go func() {
+			_ = p.server.Shutdown(context.Background())
+			p.CloseIdleConnections()
+		}()
+	}
+	return err
 }
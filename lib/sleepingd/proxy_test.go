@@ -1,16 +1,22 @@
 package sleepingd
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_Proxy_HTTP(t *testing.T) {
@@ -85,7 +91,7 @@ func getEchoserver(t *testing.T, protocol string, addr string) net.Listener {
 		for {
 			conn, err := l.Accept()
 			if err != nil {
-				continue
+				return
 			}
 			go io.Copy(conn, conn)
 		}
@@ -103,10 +109,11 @@ func Test_Proxy_NewConnectionCallback(t *testing.T) {
 		Protocol:     "tcp",
 		ListenAddr:   "127.0.0.1:7001",
 		UpstreamAddr: "127.0.0.1:7000",
-		NewConnectionCallback: func() {
+		NewConnectionCallback: func() error {
 			numConnsLock.Lock()
 			defer numConnsLock.Unlock()
 			numConns += 1
+			return nil
 		},
 	})
 	assert.NoError(t, err)
@@ -276,3 +283,574 @@ func Test_Proxy_MemoryLeak(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 	assert.Zero(t, globalCopyCounter)
 }
+
+func Test_Proxy_SetUpstream(t *testing.T) {
+	globalCopyCounter = 0 // in case messed up by another failing test
+	echoserver := getEchoserver(t, "tcp", "127.0.0.1:7002")
+	defer echoserver.Close()
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:     "tcp",
+		ListenAddr:   "127.0.0.1:7001",
+		UpstreamAddr: "127.0.0.1:7000",
+	})
+	assert.NoError(t, err)
+	defer proxy.Close()
+	proxy.SetUpstream("tcp", "127.0.0.1:7002")
+	protocol, addr := proxy.Upstream()
+	assert.Equal(t, "tcp", protocol)
+	assert.Equal(t, "127.0.0.1:7002", addr)
+	conn, err := net.Dial("tcp", "127.0.0.1:7001")
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	assert.NoError(t, conn.Close())
+	// Nothing should be running anymore
+	time.Sleep(100 * time.Millisecond)
+	assert.Zero(t, globalCopyCounter)
+}
+
+func Test_Proxy_Unix(t *testing.T) {
+	globalCopyCounter = 0 // in case messed up by another failing test
+	dir := t.TempDir()
+	upstreamPath := filepath.Join(dir, "upstream.sock")
+	listenPath := filepath.Join(dir, "listen.sock")
+	echoserver := getEchoserver(t, "unix", upstreamPath)
+	defer echoserver.Close()
+	// Unix domain socket to Unix domain socket
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:     "unix",
+		ListenAddr:   listenPath,
+		UpstreamAddr: upstreamPath,
+		SocketMode:   0o660,
+	})
+	assert.NoError(t, err)
+	info, err := os.Stat(listenPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o660), info.Mode().Perm())
+	// TCP to Unix domain socket
+	proxy2, err := NewProxy(&ProxyOptions{
+		Protocol:         "tcp",
+		ListenAddr:       "127.0.0.1:7001",
+		UpstreamProtocol: "unix",
+		UpstreamAddr:     upstreamPath,
+	})
+	assert.NoError(t, err)
+	defer proxy2.Close()
+	for _, addr := range [][2]string{{"unix", listenPath}, {"tcp", "127.0.0.1:7001"}} {
+		conn, err := net.Dial(addr[0], addr[1])
+		assert.NoError(t, err)
+		_, err = conn.Write([]byte("hello"))
+		assert.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+		assert.NoError(t, conn.Close())
+	}
+	// Socket file is cleaned up when the proxy is closed
+	assert.NoError(t, proxy.Close())
+	_, err = os.Stat(listenPath)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	// Nothing should be running anymore
+	time.Sleep(100 * time.Millisecond)
+	assert.Zero(t, globalCopyCounter)
+}
+
+func Test_Proxy_ActiveConnections(t *testing.T) {
+	echoserver := getEchoserver(t, "tcp", "127.0.0.1:7000")
+	defer echoserver.Close()
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:     "tcp",
+		ListenAddr:   "127.0.0.1:7001",
+		UpstreamAddr: "127.0.0.1:7000",
+	})
+	assert.NoError(t, err)
+	conn, err := net.Dial("tcp", "127.0.0.1:7001")
+	assert.NoError(t, err)
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, proxy.ActiveConnections())
+	// Connections in progress keep working after the proxy is
+	// closed
+	assert.NoError(t, proxy.Close())
+	assert.NoError(t, proxy.Close())
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	_, err = net.Dial("tcp", "127.0.0.1:7001")
+	assert.Error(t, err)
+	conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, proxy.ActiveConnections())
+}
+
+// Listen for connections on the given protocol and addr, and reply to
+// each one with the data received, but only once the client has
+// finished sending.
+func getReplyAfterEOFServer(t *testing.T, protocol string, addr string) net.Listener {
+	l, err := net.Listen(protocol, addr)
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				data, err := io.ReadAll(c)
+				if err != nil {
+					return
+				}
+				_, _ = c.Write(append([]byte("got: "), data...))
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func Test_Proxy_HalfClose(t *testing.T) {
+	tests := []struct {
+		Description string
+		HalfClose   bool
+		Expected    string
+	}{
+		{
+			Description: "response is lost by default",
+			HalfClose:   false,
+			Expected:    "",
+		},
+		{
+			Description: "response arrives with half-close",
+			HalfClose:   true,
+			Expected:    "got: request",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			globalCopyCounter = 0 // in case messed up by another failing test
+			server := getReplyAfterEOFServer(t, "tcp", "127.0.0.1:7000")
+			defer server.Close()
+			proxy, err := NewProxy(&ProxyOptions{
+				Protocol:     "tcp",
+				ListenAddr:   "127.0.0.1:7001",
+				UpstreamAddr: "127.0.0.1:7000",
+				HalfClose:    test.HalfClose,
+			})
+			require.NoError(t, err)
+			defer proxy.Close()
+			conn, err := net.Dial("tcp", "127.0.0.1:7001")
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte("request"))
+			require.NoError(t, err)
+			require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+			data, _ := io.ReadAll(conn)
+			assert.Equal(t, test.Expected, string(data))
+			// Nothing should be running anymore
+			time.Sleep(100 * time.Millisecond)
+			assert.Zero(t, globalCopyCounter)
+		})
+	}
+}
+
+// Listen for connections on the given protocol and addr, and send
+// data on each one as fast as possible until it is closed.
+func getFloodServer(t *testing.T, protocol string, addr string) net.Listener {
+	l, err := net.Listen(protocol, addr)
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				buf := make([]byte, 32*1024)
+				for {
+					if _, err := c.Write(buf); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func Test_Proxy_Timeouts(t *testing.T) {
+	tests := []struct {
+		Description string
+		Flood       bool
+		Options     ProxyOptions
+		Wait        time.Duration
+		Expected    string
+	}{
+		{
+			Description: "client closes first",
+			Options:     ProxyOptions{IdleTimeout: time.Second},
+			Expected:    closeReasonClient,
+		},
+		{
+			Description: "idle connection is closed",
+			Options:     ProxyOptions{IdleTimeout: 200 * time.Millisecond},
+			Wait:        500 * time.Millisecond,
+			Expected:    closeReasonIdleTimeout,
+		},
+		{
+			Description: "old connection is closed",
+			Options:     ProxyOptions{MaxAge: 200 * time.Millisecond},
+			Wait:        500 * time.Millisecond,
+			Expected:    closeReasonMaxAge,
+		},
+		{
+			Description: "connection to slow reader is closed",
+			Flood:       true,
+			Options:     ProxyOptions{WriteTimeout: 200 * time.Millisecond},
+			Wait:        2 * time.Second,
+			Expected:    closeReasonWriteTimeout,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			globalCopyCounter = 0 // in case messed up by another failing test
+			var server net.Listener
+			if test.Flood {
+				server = getFloodServer(t, "tcp", "127.0.0.1:7000")
+			} else {
+				server = getEchoserver(t, "tcp", "127.0.0.1:7000")
+			}
+			defer server.Close()
+			reasons := make(chan string, 1)
+			opts := test.Options
+			opts.Protocol = "tcp"
+			opts.ListenAddr = "127.0.0.1:7001"
+			opts.UpstreamAddr = "127.0.0.1:7000"
+			opts.ClosedCallback = func(reason string) {
+				reasons <- reason
+			}
+			proxy, err := NewProxy(&opts)
+			require.NoError(t, err)
+			defer proxy.Close()
+			conn, err := net.Dial("tcp", "127.0.0.1:7001")
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err)
+			if !test.Flood {
+				buf := make([]byte, 5)
+				_, err = io.ReadFull(conn, buf)
+				require.NoError(t, err)
+			}
+			select {
+			case reason := <-reasons:
+				assert.Fail(t, "connection closed ahead of time", reason)
+			case <-time.After(100 * time.Millisecond):
+				// proceed
+			}
+			if test.Wait == 0 {
+				require.NoError(t, conn.Close())
+			}
+			select {
+			case reason := <-reasons:
+				assert.Equal(t, test.Expected, reason)
+			case <-time.After(test.Wait + time.Second):
+				assert.Fail(t, "connection not closed soon enough")
+			}
+			// Nothing should be running anymore
+			time.Sleep(100 * time.Millisecond)
+			assert.Zero(t, globalCopyCounter)
+		})
+	}
+}
+
+func Test_Proxy_DialRetry(t *testing.T) {
+	numWakes := 0
+	numWakesLock := &sync.Mutex{}
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:     "tcp",
+		ListenAddr:   "127.0.0.1:7001",
+		UpstreamAddr: "127.0.0.1:7000",
+		NewConnectionCallback: func() error {
+			numWakesLock.Lock()
+			defer numWakesLock.Unlock()
+			numWakes += 1
+			return nil
+		},
+		DialAttempts: 5,
+		DialBackoff:  100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	conn, err := net.Dial("tcp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	// Upstream comes up after the first attempts failed
+	time.Sleep(200 * time.Millisecond)
+	echoserver := getEchoserver(t, "tcp", "127.0.0.1:7000")
+	defer echoserver.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	// Woken up again before each retry
+	numWakesLock.Lock()
+	defer numWakesLock.Unlock()
+	assert.Greater(t, numWakes, 1)
+}
+
+// Listen for connections on the given protocol and addr, and send a
+// greeting on each one as soon as it is accepted, like an SMTP
+// server.
+func getGreeter(t *testing.T, protocol string, addr string) net.Listener {
+	l, err := net.Listen(protocol, addr)
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				_, _ = c.Write([]byte("220 hello\n"))
+				_, _ = io.Copy(io.Discard, c)
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func Test_Proxy_WakeOnConnect(t *testing.T) {
+	tests := []struct {
+		Description    string
+		WakeOnConnect  bool
+		Grace          time.Duration
+		CloseRightAway bool
+		ExpectWake     bool
+		ExpectGreeting bool
+	}{
+		{
+			Description:    "client has to speak first by default",
+			WakeOnConnect:  false,
+			ExpectWake:     false,
+			ExpectGreeting: false,
+		},
+		{
+			Description:    "server speaks first",
+			WakeOnConnect:  true,
+			ExpectWake:     true,
+			ExpectGreeting: true,
+		},
+		{
+			Description:    "server speaks first after grace period",
+			WakeOnConnect:  true,
+			Grace:          100 * time.Millisecond,
+			ExpectWake:     true,
+			ExpectGreeting: true,
+		},
+		{
+			Description:    "probe within grace period is ignored",
+			WakeOnConnect:  true,
+			Grace:          100 * time.Millisecond,
+			CloseRightAway: true,
+			ExpectWake:     false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			greeter := getGreeter(t, "tcp", "127.0.0.1:7000")
+			defer greeter.Close()
+			var woken atomic.Bool
+			proxy, err := NewProxy(&ProxyOptions{
+				Protocol:     "tcp",
+				ListenAddr:   "127.0.0.1:7001",
+				UpstreamAddr: "127.0.0.1:7000",
+				NewConnectionCallback: func() error {
+					woken.Store(true)
+					return nil
+				},
+				WakeOnConnect:      test.WakeOnConnect,
+				WakeOnConnectGrace: test.Grace,
+			})
+			require.NoError(t, err)
+			defer proxy.Close()
+			conn, err := net.Dial("tcp", "127.0.0.1:7001")
+			require.NoError(t, err)
+			defer conn.Close()
+			if test.CloseRightAway {
+				require.NoError(t, conn.Close())
+			} else {
+				require.NoError(t, conn.SetReadDeadline(time.Now().Add(300*time.Millisecond)))
+				buf := make([]byte, 10)
+				_, err = io.ReadFull(conn, buf)
+				if test.ExpectGreeting {
+					assert.NoError(t, err)
+					assert.Equal(t, "220 hello\n", string(buf))
+				} else {
+					assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+				}
+			}
+			time.Sleep(200 * time.Millisecond)
+			assert.Equal(t, test.ExpectWake, woken.Load())
+		})
+	}
+}
+
+func Test_Proxy_ClientRules(t *testing.T) {
+	denyLocal, err := ParseClientRules([]string{"!127.0.0.0/8"})
+	require.NoError(t, err)
+	tests := []struct {
+		Description   string
+		ConnectFrom   *ClientRules
+		WakeFrom      *ClientRules
+		KeepAwakeFrom *ClientRules
+		Ready         bool
+		ExpectEcho    bool
+		ExpectWake    bool
+		ExpectData    bool
+		ExpectReason  string
+	}{
+		{
+			Description:  "no rules",
+			ExpectEcho:   true,
+			ExpectWake:   true,
+			ExpectData:   true,
+			ExpectReason: closeReasonClient,
+		},
+		{
+			Description:  "client may not connect",
+			ConnectFrom:  denyLocal,
+			Ready:        true,
+			ExpectReason: closeReasonDenied,
+		},
+		{
+			Description: "client may not wake the upstream",
+			WakeFrom:    denyLocal,
+			// The data is read before the upstream would
+			// be woken up
+			ExpectData:   true,
+			ExpectReason: closeReasonDenied,
+		},
+		{
+			Description:  "client may use the upstream once awake",
+			WakeFrom:     denyLocal,
+			Ready:        true,
+			ExpectEcho:   true,
+			ExpectWake:   true,
+			ExpectData:   true,
+			ExpectReason: closeReasonClient,
+		},
+		{
+			Description:   "client does not keep the upstream awake",
+			KeepAwakeFrom: denyLocal,
+			ExpectEcho:    true,
+			ExpectWake:    true,
+			ExpectReason:  closeReasonClient,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			echoserver := getEchoserver(t, "tcp", "127.0.0.1:7000")
+			defer echoserver.Close()
+			var woken, data atomic.Bool
+			reasons := make(chan string, 1)
+			proxy, err := NewProxy(&ProxyOptions{
+				Protocol:     "tcp",
+				ListenAddr:   "127.0.0.1:7001",
+				UpstreamAddr: "127.0.0.1:7000",
+				NewConnectionCallback: func() error {
+					woken.Store(true)
+					return nil
+				},
+				ReadyCallback:  func() bool { return test.Ready },
+				DataCallback:   func() { data.Store(true) },
+				ClosedCallback: func(reason string) { reasons <- reason },
+				ConnectFrom:    test.ConnectFrom,
+				WakeFrom:       test.WakeFrom,
+				KeepAwakeFrom:  test.KeepAwakeFrom,
+			})
+			require.NoError(t, err)
+			defer proxy.Close()
+			// The connection may be reset at any point, even
+			// before Dial returns.
+			buf := make([]byte, 5)
+			conn, err := net.Dial("tcp", "127.0.0.1:7001")
+			if err == nil {
+				defer conn.Close()
+				require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+				_, err = conn.Write([]byte("hello"))
+			}
+			if err == nil {
+				_, err = io.ReadFull(conn, buf)
+			}
+			if test.ExpectEcho {
+				assert.NoError(t, err)
+				assert.Equal(t, "hello", string(buf))
+				require.NoError(t, conn.Close())
+			} else {
+				assert.True(t, errors.Is(err, syscall.ECONNRESET), "expected reset, got %v", err)
+			}
+			select {
+			case reason := <-reasons:
+				assert.Equal(t, test.ExpectReason, reason)
+			case <-time.After(time.Second):
+				t.Fatal("connection was not closed")
+			}
+			assert.Equal(t, test.ExpectWake, woken.Load())
+			assert.Equal(t, test.ExpectData, data.Load())
+		})
+	}
+}
+
+func Test_Proxy_WakeError(t *testing.T) {
+	echoserver := getEchoserver(t, "tcp", "127.0.0.1:7000")
+	defer echoserver.Close()
+	fail := &atomic.Bool{}
+	fail.Store(true)
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:     "tcp",
+		ListenAddr:   "127.0.0.1:7001",
+		UpstreamAddr: "127.0.0.1:7000",
+		NewConnectionCallback: func() error {
+			if fail.Load() {
+				return errors.New("failed to start")
+			}
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	// Only the connection that triggered the wake-up fails
+	conn, err := net.Dial("tcp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, syscall.ECONNRESET), "expected reset, got %v", err)
+	fail.Store(false)
+	conn, err = net.Dial("tcp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
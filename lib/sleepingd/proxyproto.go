@@ -0,0 +1,258 @@
+package sleepingd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderV2Signature starts every PROXY protocol version 2
+// header, see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+var proxyHeaderV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeaderTimeout is how long to wait for a client to send its
+// PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// WriteProxyHeader writes a PROXY protocol header of the given
+// version (1 or 2) to w, identifying a connection from src to dst. If
+// either address is not a TCP address, then a header is written that
+// tells the receiver to use the real addresses of the connection
+// instead (UNKNOWN in version 1, LOCAL in version 2).
+func WriteProxyHeader(w io.Writer, version int, src net.Addr, dst net.Addr) error {
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	known := srcOK && dstOK
+	var srcIP, dstIP net.IP
+	ipv4 := false
+	if known {
+		srcIP, dstIP = srcTCP.IP, dstTCP.IP
+		if srcIP.To4() != nil && dstIP.To4() != nil {
+			srcIP, dstIP = srcIP.To4(), dstIP.To4()
+			ipv4 = true
+		} else {
+			srcIP, dstIP = srcIP.To16(), dstIP.To16()
+		}
+	}
+	switch version {
+	case 1:
+		if !known {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		family := "TCP6"
+		if ipv4 {
+			family = "TCP4"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcTCP.Port, dstTCP.Port)
+		return err
+	case 2:
+		header := bytes.Buffer{}
+		header.Write(proxyHeaderV2Signature)
+		if !known {
+			// Version 2, LOCAL command, unspecified family,
+			// no addresses.
+			header.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			_, err := w.Write(header.Bytes())
+			return err
+		}
+		family := byte(0x21) // TCP over IPv6
+		if ipv4 {
+			family = 0x11 // TCP over IPv4
+		}
+		// Version 2, PROXY command.
+		header.Write([]byte{0x21, family})
+		_ = binary.Write(&header, binary.BigEndian, uint16(2*len(srcIP)+4))
+		header.Write(srcIP)
+		header.Write(dstIP)
+		_ = binary.Write(&header, binary.BigEndian, uint16(srcTCP.Port))
+		_ = binary.Write(&header, binary.BigEndian, uint16(dstTCP.Port))
+		_, err := w.Write(header.Bytes())
+		return err
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+}
+
+// ReadProxyHeader reads a PROXY protocol header of either version
+// from r, and returns the source and destination addresses of the
+// original connection. If the header does not identify the original
+// connection (UNKNOWN in version 1, LOCAL or an unsupported family in
+// version 2), then the addresses are nil.
+func ReadProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// Only peek as much as necessary, since the shortest
+	// version 1 header is shorter than the version 2 signature.
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyHeaderV1(r)
+	case proxyHeaderV2Signature[0]:
+		start, err := r.Peek(len(proxyHeaderV2Signature))
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+		}
+		if bytes.Equal(start, proxyHeaderV2Signature) {
+			return readProxyHeaderV2(r)
+		}
+	}
+	return nil, nil, errors.New("missing PROXY protocol header")
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// The longest possible header is 107 bytes.
+	line := []byte{}
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return nil, nil, errors.New("PROXY protocol header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, nil, errors.New("missing PROXY protocol header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY protocol header %q", strings.TrimSpace(string(line)))
+	}
+	src, err := parseProxyHeaderAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyHeaderAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyHeaderAddr(ip string, port string) (*net.TCPAddr, error) {
+	parsedIP := net.ParseIP(ip)
+	parsedPort, err := strconv.ParseUint(port, 10, 16)
+	if parsedIP == nil || err != nil {
+		return nil, fmt.Errorf("invalid address in PROXY protocol header: %s port %s", ip, port)
+	}
+	return &net.TCPAddr{IP: parsedIP, Port: int(parsedPort)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	if header[12]&0x0f == 0 {
+		// LOCAL command, e.g. a health check from the load
+		// balancer itself.
+		return nil, nil, nil
+	}
+	var ipLen int
+	switch header[13] {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		ipLen = 4
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		ipLen = 16
+	default:
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, errors.New("PROXY protocol header too short")
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(body[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(body[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
+
+// proxyHeaderListener wraps a listener whose clients send a PROXY
+// protocol header at the start of each connection, e.g. because it is
+// behind a load balancer. The accepted connections report the
+// addresses from the header as their local and remote addresses.
+type proxyHeaderListener struct {
+	net.Listener
+}
+
+func (l *proxyHeaderListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyHeaderConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyHeaderConn reads the PROXY protocol header the first time it
+// is needed, rather than in Accept, so that a slow client does not
+// hold up other connections.
+type proxyHeaderConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyHeaderConn) readHeader() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remoteAddr, c.localAddr, c.err = ReadProxyHeader(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			LogError(fmt.Errorf("from %s: %w", c.Conn.RemoteAddr(), c.err))
+			_ = c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyHeaderConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyHeaderConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyHeaderConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,167 @@
+package sleepingd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ProxyHeader_RoundTrip(t *testing.T) {
+	addrs := [][2]net.Addr{
+		{
+			&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+			&net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 443},
+		},
+		{
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+	}
+	for _, version := range []int{1, 2} {
+		for _, pair := range addrs {
+			buf := bytes.Buffer{}
+			require.NoError(t, WriteProxyHeader(&buf, version, pair[0], pair[1]))
+			buf.WriteString("payload")
+			r := bufio.NewReader(&buf)
+			src, dst, err := ReadProxyHeader(r)
+			require.NoError(t, err)
+			assert.Equal(t, pair[0].String(), src.String())
+			assert.Equal(t, pair[1].String(), dst.String())
+			rest, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, "payload", string(rest))
+		}
+	}
+}
+
+func Test_ProxyHeader_V1Format(t *testing.T) {
+	buf := bytes.Buffer{}
+	require.NoError(t, WriteProxyHeader(
+		&buf, 1,
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+		&net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 443},
+	))
+	assert.Equal(t, "PROXY TCP4 192.0.2.1 198.51.100.7 56324 443\r\n", buf.String())
+}
+
+func Test_ProxyHeader_Unknown(t *testing.T) {
+	src := &net.UnixAddr{Name: "/run/client.sock", Net: "unix"}
+	dst := &net.UnixAddr{Name: "/run/server.sock", Net: "unix"}
+	for _, version := range []int{1, 2} {
+		buf := bytes.Buffer{}
+		require.NoError(t, WriteProxyHeader(&buf, version, src, dst))
+		readSrc, readDst, err := ReadProxyHeader(bufio.NewReader(&buf))
+		require.NoError(t, err)
+		assert.Nil(t, readSrc)
+		assert.Nil(t, readDst)
+		assert.Zero(t, buf.Len())
+	}
+}
+
+func Test_ProxyHeader_Invalid(t *testing.T) {
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.0.2.1\r\n",
+		"PROXY TCP4 nonsense 198.51.100.7 56324 443\r\n",
+		"PROXY " + strings.Repeat("x", 200),
+		"\r\n\r\n\x00\r\nQUIZ\n",
+	} {
+		_, _, err := ReadProxyHeader(bufio.NewReader(strings.NewReader(header)))
+		assert.Error(t, err, header)
+	}
+}
+
+// getAddrEchoServer returns a server that reads a PROXY protocol
+// header from each connection, and responds with the source address
+// from the header.
+func getAddrEchoServer(t *testing.T, addr string) net.Listener {
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				src, _, err := ReadProxyHeader(bufio.NewReader(c))
+				if err != nil {
+					_, _ = c.Write([]byte(err.Error()))
+					return
+				}
+				_, _ = c.Write([]byte(src.String()))
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func Test_Proxy_ProxyHeader(t *testing.T) {
+	upstream := getAddrEchoServer(t, "127.0.0.1:7000")
+	defer upstream.Close()
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:          "tcp",
+		ListenAddr:        "127.0.0.1:7001",
+		UpstreamAddr:      "127.0.0.1:7000",
+		SendProxyHeader:   2,
+		AcceptProxyHeader: true,
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	conn, err := net.Dial("tcp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	defer conn.Close()
+	// Pretend to be a load balancer
+	require.NoError(t, WriteProxyHeader(
+		conn, 1,
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+		&net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 443},
+	))
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	data, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:56324", string(data))
+}
+
+func Test_HTTPProxy_ProxyHeader(t *testing.T) {
+	start, ready := getHTTPUpstream(t, 0)
+	start()
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:          "tcp",
+		ListenAddr:        "127.0.0.1:7001",
+		UpstreamAddr:      "127.0.0.1:7000",
+		ReadyCallback:     ready,
+		AcceptProxyHeader: true,
+		HTTP:              &HTTPOptions{},
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	conn, err := net.Dial("tcp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, WriteProxyHeader(
+		conn, 2,
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+		&net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 443},
+	))
+	req, err := http.NewRequest("GET", "http://127.0.0.1:7001/", nil)
+	require.NoError(t, err)
+	require.NoError(t, req.Write(conn))
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "forwarded for 192.0.2.1", string(body))
+}
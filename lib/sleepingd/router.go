@@ -0,0 +1,326 @@
+package sleepingd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// routePeekTimeout is how long to wait for a client to send enough
+// data to decide which route its connection belongs to.
+const routePeekTimeout = 10 * time.Second
+
+// routePeekLimit is the maximum number of bytes read from a client to
+// find the TLS server name or HTTP Host header.
+const routePeekLimit = 16 * 1024
+
+// RouteOptions is used to configure ListenRouted, which see for
+// documentation.
+type RouteOptions struct {
+	// Protocol is "tcp" or "unix", and ListenAddr is the address
+	// or socket path to listen on, as for ProxyOptions.
+	Protocol   string
+	ListenAddr string
+	// Listener is used instead of listening on ListenAddr,
+	// optional, e.g. a listener returned by ActivationListener.
+	// If another route already listens on the same address, then
+	// it is closed instead. ListenAddr is still used to identify
+	// the address.
+	Listener net.Listener
+	// SocketMode, SocketOwner, and AcceptProxyHeader configure
+	// the shared listener as for ProxyOptions. They are taken
+	// from whichever route opens the listener first, and ignored
+	// for the others.
+	SocketMode        os.FileMode
+	SocketOwner       string
+	AcceptProxyHeader bool
+	// Hostnames lists the names that are routed to this route,
+	// matched against the TLS server name (SNI) or the HTTP Host
+	// header, case insensitively. A name may start with "*." to
+	// match any single label in its place.
+	Hostnames []string
+	// Default makes this route receive connections that do not
+	// match the hostnames of any route on the same address.
+	Default bool
+}
+
+// router accepts connections on a listener shared by several routes,
+// and hands each one to the route it belongs to.
+type router struct {
+	key      string
+	listener net.Listener
+
+	// lock must be held to access routes, defaultRoute, or
+	// numRoutes.
+	lock         sync.Mutex
+	routes       map[string]*routeListener
+	defaultRoute *routeListener
+	numRoutes    int
+}
+
+var (
+	// routersLock must be held to access routers, which maps
+	// listen addresses (see describeAddr) to the routers
+	// listening on them.
+	routersLock sync.Mutex
+	routers     = map[string]*router{}
+)
+
+// ListenRouted returns a listener that receives the connections to
+// opts.ListenAddr that are destined for opts.Hostnames (or that match
+// no other route, if opts.Default is set). The first call for an
+// address starts listening on it, and later calls share the same
+// socket, so that several proxies can serve different hostnames from
+// the same port. The socket is closed once every listener returned
+// for it has been closed.
+//
+// The hostname of each connection is found by reading the server
+// name from the TLS ClientHello, without terminating TLS, or else by
+// reading the Host header of the first HTTP request. The data read is
+// then replayed to the route, so TLS can be terminated by the route's
+// proxy or by the upstream. Later requests on an HTTP keep-alive
+// connection go to the same route as the first one. Connections that
+// do not match any route go to the default route, or are closed if
+// there is none.
+//
+// If a hostname is given that another route on the same address
+// already has, then the new route takes over the hostname, so that a
+// replacement proxy can be started before the old one is closed.
+func ListenRouted(opts *RouteOptions) (net.Listener, error) {
+	key := describeAddr(opts.Protocol, opts.ListenAddr)
+	routersLock.Lock()
+	defer routersLock.Unlock()
+	r, ok := routers[key]
+	if ok && opts.Listener != nil {
+		LogError(opts.Listener.Close())
+	}
+	if !ok {
+		l := opts.Listener
+		var err error
+		if l != nil {
+			// Already listening
+		} else if opts.Protocol == "unix" {
+			l, err = listenUnix(opts.ListenAddr, opts.SocketMode, opts.SocketOwner)
+		} else {
+			l, err = net.Listen(opts.Protocol, opts.ListenAddr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if opts.AcceptProxyHeader {
+			l = &proxyHeaderListener{Listener: l}
+		}
+		r = &router{
+			key:      key,
+			listener: l,
+			routes:   map[string]*routeListener{},
+		}
+		routers[key] = r
+		go r.serve()
+	}
+	rl := &routeListener{
+		router: r,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, hostname := range opts.Hostnames {
+		r.routes[normalizeHostname(hostname)] = rl
+	}
+	if opts.Default {
+		r.defaultRoute = rl
+	}
+	r.numRoutes++
+	return rl, nil
+}
+
+func normalizeHostname(hostname string) string {
+	return strings.TrimSuffix(strings.ToLower(hostname), ".")
+}
+
+func (r *router) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			continue
+		}
+		go r.route(conn)
+	}
+}
+
+// route finds the route for conn and hands it over, or closes it if
+// there is no route for it.
+func (r *router) route(conn net.Conn) {
+	if phc, ok := conn.(*proxyHeaderConn); ok {
+		// Read the PROXY protocol header first, since it
+		// resets the deadline when done.
+		phc.readHeader()
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(routePeekTimeout))
+	hostname, rc := peekHostname(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	rl := r.lookup(hostname)
+	if rl == nil {
+		Log("no route for connection from %s to hostname %q", conn.RemoteAddr(), hostname)
+		_ = conn.Close()
+		return
+	}
+	select {
+	case rl.conns <- rc:
+	case <-rl.closed:
+		_ = conn.Close()
+	}
+}
+
+func (r *router) lookup(hostname string) *routeListener {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if hostname != "" {
+		hostname = normalizeHostname(hostname)
+		if rl, ok := r.routes[hostname]; ok {
+			return rl
+		}
+		if _, parent, ok := strings.Cut(hostname, "."); ok {
+			if rl, ok := r.routes["*."+parent]; ok {
+				return rl
+			}
+		}
+	}
+	return r.defaultRoute
+}
+
+// remove unregisters rl, and closes the shared listener if it was the
+// last route.
+func (r *router) remove(rl *routeListener) error {
+	routersLock.Lock()
+	defer routersLock.Unlock()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for hostname, other := range r.routes {
+		if other == rl {
+			delete(r.routes, hostname)
+		}
+	}
+	if r.defaultRoute == rl {
+		r.defaultRoute = nil
+	}
+	r.numRoutes--
+	if r.numRoutes > 0 {
+		return nil
+	}
+	delete(routers, r.key)
+	return r.listener.Close()
+}
+
+// peekHostname reads from conn until it can tell which hostname the
+// client wants, and returns it (or "" if it cannot be determined)
+// along with a connection that replays the data that was read.
+func peekHostname(conn net.Conn) (string, net.Conn) {
+	br := bufio.NewReaderSize(conn, routePeekLimit)
+	rc := &peekedConn{Conn: conn, reader: br}
+	first, err := br.Peek(1)
+	if err != nil {
+		return "", rc
+	}
+	recorded := &bytes.Buffer{}
+	tee := io.TeeReader(io.LimitReader(br, routePeekLimit), recorded)
+	hostname := ""
+	if first[0] == 0x16 {
+		// TLS handshake record
+		hostname = readServerName(tee)
+	} else if req, err := http.ReadRequest(bufio.NewReader(tee)); err == nil {
+		hostname = req.Host
+		if host, _, err := net.SplitHostPort(hostname); err == nil {
+			hostname = host
+		}
+	}
+	rc.reader = io.MultiReader(recorded, br)
+	return hostname, rc
+}
+
+// errClientHelloRead is used to abort the handshake in
+// readServerName once the ClientHello has been read.
+var errClientHelloRead = errors.New("client hello read")
+
+// readServerName reads a TLS ClientHello from r and returns the
+// server name requested with SNI, or "" if there is none.
+func readServerName(r io.Reader) string {
+	serverName := ""
+	_ = tls.Server(&readOnlyConn{reader: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	return serverName
+}
+
+// readOnlyConn is a net.Conn that reads from a reader, for parsing a
+// handshake without responding to it.
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error) { return c.reader.Read(b) }
+func (c *readOnlyConn) Write(b []byte) (int, error) {
+	return 0, errors.New("write to read-only connection")
+}
+func (c *readOnlyConn) Close() error                       { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c *readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c *readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// peekedConn is a connection from which some data has already been
+// read, which is replayed by reader.
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// routeListener is the listener for a single route, returned by
+// ListenRouted.
+type routeListener struct {
+	router    *router
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *routeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *routeListener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.router.remove(l)
+	})
+	return err
+}
+
+func (l *routeListener) Addr() net.Addr {
+	return l.router.listener.Addr()
+}
@@ -0,0 +1,178 @@
+package sleepingd
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// acceptData accepts a connection from l and returns the first n
+// bytes received on it, failing the test if that takes too long.
+func acceptData(t *testing.T, l net.Listener, n int) string {
+	connCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			connCh <- conn
+		}
+	}()
+	select {
+	case conn := <-connCh:
+		defer conn.Close()
+		buf := make([]byte, n)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		_, err := io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		return string(buf)
+	case <-time.After(time.Second):
+		require.Fail(t, "no connection accepted")
+		return ""
+	}
+}
+
+func Test_ListenRouted_Host(t *testing.T) {
+	a, err := ListenRouted(&RouteOptions{
+		Protocol:   "tcp",
+		ListenAddr: "127.0.0.1:7001",
+		Hostnames:  []string{"a.example.com", "*.b.example.com"},
+	})
+	require.NoError(t, err)
+	defer a.Close()
+	def, err := ListenRouted(&RouteOptions{
+		Protocol:   "tcp",
+		ListenAddr: "127.0.0.1:7001",
+		Default:    true,
+	})
+	require.NoError(t, err)
+	defer def.Close()
+	for _, tc := range []struct {
+		request string
+		route   net.Listener
+	}{
+		{"GET / HTTP/1.1\r\nHost: a.example.com\r\n\r\n", a},
+		{"GET / HTTP/1.1\r\nHost: A.Example.Com:7001\r\n\r\n", a},
+		{"GET / HTTP/1.1\r\nHost: x.b.example.com\r\n\r\n", a},
+		{"GET / HTTP/1.1\r\nHost: b.example.com\r\n\r\n", def},
+		{"GET / HTTP/1.1\r\nHost: c.example.com\r\n\r\n", def},
+		{"hello, not http\r\n\r\n", def},
+	} {
+		conn, err := net.Dial("tcp", "127.0.0.1:7001")
+		require.NoError(t, err)
+		_, err = conn.Write([]byte(tc.request))
+		require.NoError(t, err)
+		// The data that was peeked is replayed in full
+		assert.Equal(t, tc.request, acceptData(t, tc.route, len(tc.request)))
+		conn.Close()
+	}
+}
+
+func Test_ListenRouted_NoDefault(t *testing.T) {
+	a, err := ListenRouted(&RouteOptions{
+		Protocol:   "tcp",
+		ListenAddr: "127.0.0.1:7001",
+		Hostnames:  []string{"a.example.com"},
+	})
+	require.NoError(t, err)
+	defer a.Close()
+	conn, err := net.Dial("tcp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: b.example.com\r\n\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func Test_ListenRouted_Takeover(t *testing.T) {
+	old, err := ListenRouted(&RouteOptions{
+		Protocol:   "tcp",
+		ListenAddr: "127.0.0.1:7001",
+		Hostnames:  []string{"a.example.com", "b.example.com"},
+	})
+	require.NoError(t, err)
+	replacement, err := ListenRouted(&RouteOptions{
+		Protocol:   "tcp",
+		ListenAddr: "127.0.0.1:7001",
+		Hostnames:  []string{"a.example.com"},
+	})
+	require.NoError(t, err)
+	request := "GET / HTTP/1.1\r\nHost: a.example.com\r\n\r\n"
+	conn, err := net.Dial("tcp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(request))
+	require.NoError(t, err)
+	assert.Equal(t, request, acceptData(t, replacement, len(request)))
+	// Closing the old route leaves the listener open for the
+	// replacement
+	require.NoError(t, old.Close())
+	conn, err = net.Dial("tcp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(request))
+	require.NoError(t, err)
+	assert.Equal(t, request, acceptData(t, replacement, len(request)))
+	// Closing the last route closes the listener
+	require.NoError(t, replacement.Close())
+	l, err := net.Listen("tcp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	l.Close()
+}
+
+func Test_Proxy_RoutedSNI(t *testing.T) {
+	echoserver := getEchoserver(t, "tcp", "127.0.0.1:7000")
+	defer echoserver.Close()
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		certFile := filepath.Join(dir, name+".pem")
+		keyFile := filepath.Join(dir, name+".key")
+		writeTestCert(t, certFile, keyFile, name, time.Now())
+		tlsConfig, err := NewTLSConfig(certFile, keyFile, "1.2", nil)
+		require.NoError(t, err)
+		l, err := ListenRouted(&RouteOptions{
+			Protocol:   "tcp",
+			ListenAddr: "127.0.0.1:7001",
+			Hostnames:  []string{name + ".example.com"},
+			Default:    name == "b",
+		})
+		require.NoError(t, err)
+		proxy, err := NewProxy(&ProxyOptions{
+			Protocol:     "tcp",
+			ListenAddr:   "127.0.0.1:7001",
+			UpstreamAddr: "127.0.0.1:7000",
+			Listener:     l,
+			TLS:          tlsConfig,
+		})
+		require.NoError(t, err)
+		defer proxy.Close()
+	}
+	for _, tc := range []struct {
+		serverName string
+		commonName string
+	}{
+		{"a.example.com", "a"},
+		{"b.example.com", "b"},
+		{"", "b"},
+	} {
+		conn, err := tls.Dial("tcp", "127.0.0.1:7001", &tls.Config{
+			ServerName:         tc.serverName,
+			InsecureSkipVerify: true,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, tc.commonName, conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+		conn.Close()
+	}
+}
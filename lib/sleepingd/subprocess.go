@@ -1,64 +1,152 @@
 package sleepingd
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
 type SubprocessManager struct {
-	Command                []string
+	// Name is used to identify the subprocess in log messages,
+	// optional.
+	Name    string
+	Command []string
+	// Dir is the working directory of the subprocess, optional.
+	// It defaults to the current working directory.
+	Dir string
+	// Env is the environment of the subprocess, as a list of
+	// "KEY=value" strings, optional. It defaults to the
+	// environment of the current process.
+	Env []string
+	// Protocol is the protocol the subprocess listens on, either
+	// "tcp" or "udp", optional. It defaults to "tcp".
+	Protocol string
+	// Host is the host that the subprocess listens on, optional.
+	// It defaults to "127.0.0.1".
+	Host string
+	// Socket is the path of the Unix domain socket that the
+	// subprocess listens on, optional. If set, then it is used
+	// instead of the port and Protocol to check whether the
+	// subprocess is listening.
+	Socket string
+	// ExtraPorts are more ports that the subprocess must listen
+	// on, in addition to the one passed to EnsureListening,
+	// before it is considered to be listening, optional.
+	ExtraPorts []int
+	// ExtraFiles are passed to the subprocess as file descriptors
+	// 3 and up, optional, see exec.Cmd.ExtraFiles.
+	ExtraFiles             []*os.File
 	TerminationGracePeriod time.Duration
 	EnsureListeningTimeout time.Duration
 	cmd                    *exec.Cmd
-	listening              bool
+	// exited is closed once cmd has exited, after which waitErr
+	// is the error returned by cmd.Wait.
+	exited    chan struct{}
+	waitErr   error
+	listening bool
+}
+
+func (sm *SubprocessManager) log(format string, args ...interface{}) {
+	if sm.Name != "" {
+		format = "[" + sm.Name + "] " + format
+	}
+	Log(format, args...)
 }
 
 func (sm *SubprocessManager) EnsureStopped() error {
 	if sm.cmd == nil {
 		return nil // already stopped
 	}
-	fmt.Fprintf(os.Stderr, "sleepingd: stopping subprocess\n")
+	sm.log("stopping subprocess")
+	// The subprocess is reaped in the background, after which its
+	// process group ID could be reused by an unrelated process,
+	// so check whether it has exited before each signal.
+	select {
+	case <-sm.exited:
+		return sm.exitResult()
+	default:
+	}
 	_ = syscall.Kill(-sm.cmd.Process.Pid, syscall.SIGTERM)
-	waitCh := make(chan error)
-	go func() {
-		waitCh <- sm.cmd.Wait()
-	}()
 	select {
-	case err := <-waitCh:
-		if _, ok := err.(*exec.ExitError); err == nil || ok {
-			sm.cmd = nil
-			return nil
-		}
-		return err
+	case <-sm.exited:
+		return sm.exitResult()
 	case <-time.NewTimer(sm.TerminationGracePeriod).C:
-		_ = syscall.Kill(-sm.cmd.Process.Pid, syscall.SIGKILL)
 	}
 	select {
-	case err := <-waitCh:
-		if _, ok := err.(*exec.ExitError); err == nil || ok {
-			sm.cmd = nil
-			return nil
-		}
-		return err
+	case <-sm.exited:
+		return sm.exitResult()
+	default:
+	}
+	_ = syscall.Kill(-sm.cmd.Process.Pid, syscall.SIGKILL)
+	select {
+	case <-sm.exited:
+		return sm.exitResult()
 	case <-time.NewTimer(1 * time.Second).C:
 		return fmt.Errorf("failed to kill pid %d", sm.cmd.Process.Pid)
 	}
 }
 
+// exitResult forgets about the subprocess once it has exited, and
+// returns the error from waiting for it, unless it is only about the
+// exit status.
+func (sm *SubprocessManager) exitResult() error {
+	if _, ok := sm.waitErr.(*exec.ExitError); sm.waitErr == nil || ok {
+		sm.cmd = nil
+		return nil
+	}
+	return sm.waitErr
+}
+
+// Pid returns the process ID of the subprocess, or zero if it is not
+// running.
+func (sm *SubprocessManager) Pid() int {
+	if sm.cmd == nil {
+		return 0
+	}
+	return sm.cmd.Process.Pid
+}
+
 func (sm *SubprocessManager) EnsureStarted() error {
 	if sm.cmd != nil {
 		return nil // already started
 	}
-	fmt.Fprintf(os.Stderr, "sleepingd: starting subprocess\n")
+	sm.log("starting subprocess")
 	sm.cmd = exec.Command(sm.Command[0], sm.Command[1:]...)
+	sm.cmd.Dir = sm.Dir
+	sm.cmd.Env = sm.Env
 	sm.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	sm.cmd.ExtraFiles = sm.ExtraFiles
 	sm.cmd.Stdout = os.Stdout
 	sm.cmd.Stderr = os.Stderr
-	return sm.cmd.Start()
+	if err := sm.cmd.Start(); err != nil {
+		sm.cmd = nil
+		return err
+	}
+	cmd := sm.cmd
+	exited := make(chan struct{})
+	sm.exited = exited
+	go func() {
+		sm.waitErr = cmd.Wait()
+		close(exited)
+	}()
+	return nil
+}
+
+// Exited returns a channel that is closed when the subprocess exits,
+// whether on its own or because it was stopped, or nil if it is not
+// running. Call EnsureStopped afterwards to clean up.
+func (sm *SubprocessManager) Exited() <-chan struct{} {
+	if sm.cmd == nil {
+		return nil
+	}
+	return sm.exited
 }
 
 func (sm *SubprocessManager) EnsureListening(port int) error {
@@ -68,9 +156,7 @@ func (sm *SubprocessManager) EnsureListening(port int) error {
 	done := make(chan error)
 	go func() {
 		for {
-			conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
-			if err == nil {
-				_ = conn.Close()
+			if all, _ := sm.isListening(port); all {
 				done <- nil
 				return
 			}
@@ -82,7 +168,7 @@ func (sm *SubprocessManager) EnsureListening(port int) error {
 		sm.listening = true
 		return err
 	case <-time.NewTimer(sm.EnsureListeningTimeout).C:
-		return fmt.Errorf("process did not start listening on port %d", port)
+		return fmt.Errorf("process did not start listening on %s", sm.describeListener(port))
 	}
 }
 
@@ -93,8 +179,7 @@ func (sm *SubprocessManager) EnsureNotListening(port int) error {
 	done := make(chan error)
 	go func() {
 		for {
-			_, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
-			if err != nil {
+			if _, some := sm.isListening(port); !some {
 				done <- nil
 				return
 			}
@@ -106,6 +191,120 @@ func (sm *SubprocessManager) EnsureNotListening(port int) error {
 		sm.listening = false
 		return err
 	case <-time.NewTimer(sm.EnsureListeningTimeout).C:
-		return fmt.Errorf("process did not stop listening on port %d", port)
+		return fmt.Errorf("process did not stop listening on %s", sm.describeListener(port))
+	}
+}
+
+// isListening reports whether the subprocess is listening on all of
+// its ports (or its socket, instead of port), and whether it is
+// listening on any of them.
+func (sm *SubprocessManager) isListening(port int) (bool, bool) {
+	all, some := true, false
+	check := func(inUse bool) {
+		all = all && inUse
+		some = some || inUse
+	}
+	if sm.Socket != "" {
+		check(socketInUse(sm.Socket))
+	} else {
+		check(portInUse(sm.Protocol, sm.host(), port))
+	}
+	for _, extraPort := range sm.ExtraPorts {
+		check(portInUse(sm.Protocol, sm.host(), extraPort))
+	}
+	return all, some
+}
+
+func (sm *SubprocessManager) describeListener(port int) string {
+	desc := fmt.Sprintf("port %d", port)
+	if sm.Socket != "" {
+		desc = sm.Socket
+	}
+	for _, extraPort := range sm.ExtraPorts {
+		desc += fmt.Sprintf(", port %d", extraPort)
+	}
+	return desc
+}
+
+// socketInUse reports whether something is listening on the Unix
+// domain socket at path.
+func socketInUse(path string) bool {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+func (sm *SubprocessManager) host() string {
+	if sm.Host == "" {
+		return "127.0.0.1"
+	}
+	return sm.Host
+}
+
+// portInUse reports whether something is listening on the given port
+// of host. For TCP this is checked by connecting to the port, which
+// looks up host again if it is a hostname. UDP is connectionless, so
+// instead the kernel's socket table is consulted, which only works
+// if host is local. Binding the port ourselves to see whether it is
+// taken would also work, but could cause the subprocess to fail to
+// bind it if it started up at the same moment.
+func portInUse(protocol string, host string, port int) bool {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if protocol != "udp" {
+		// Don't hang if host is remote and drops packets.
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			return false
+		}
+		_ = conn.Close()
+		return true
+	}
+	bound, err := udpPortBound(port)
+	if err != nil {
+		// No /proc, e.g. not on Linux. Fall back to
+		// binding the port after all.
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return true
+		}
+		_ = pc.Close()
+		return false
+	}
+	return bound
+}
+
+// isLoopbackHost reports whether host is "localhost" or a loopback
+// IP address.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// udpPortBound reports whether any UDP socket is bound to the given
+// local port, according to /proc/net/udp and /proc/net/udp6.
+func udpPortBound(port int) (bool, error) {
+	suffix := fmt.Sprintf(":%04X", port)
+	found := false
+	for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) && path == "/proc/net/udp6" {
+			// IPv6 disabled.
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && strings.HasSuffix(fields[1], suffix) {
+				found = true
+			}
+		}
 	}
+	return found, nil
 }
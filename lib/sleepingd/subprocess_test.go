@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_SubprocessManager(t *testing.T) {
@@ -42,6 +43,30 @@ func Test_SubprocessManager(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func Test_SubprocessManagerExited(t *testing.T) {
+	f, err := os.Open("/dev/null")
+	assert.NoError(t, err)
+	defer f.Close()
+	sm := &SubprocessManager{
+		// Fails unless file descriptor 3 is passed
+		Command:                []string{"sh", "-c", "exec 0<&3"},
+		ExtraFiles:             []*os.File{f},
+		TerminationGracePeriod: 100 * time.Millisecond,
+	}
+	assert.Nil(t, sm.Exited())
+	assert.NoError(t, sm.EnsureStarted())
+	select {
+	case <-sm.Exited():
+	case <-time.After(time.Second):
+		assert.Fail(t, "subprocess did not exit")
+	}
+	assert.NoError(t, sm.waitErr)
+	assert.NotZero(t, sm.Pid())
+	assert.NoError(t, sm.EnsureStopped())
+	assert.Zero(t, sm.Pid())
+	assert.Nil(t, sm.Exited())
+}
+
 func assertPortBound(t *testing.T, port int, shouldBeBound bool) {
 	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
 	if shouldBeBound && err != nil {
@@ -55,6 +80,24 @@ func assertPortBound(t *testing.T, port int, shouldBeBound bool) {
 	}
 }
 
+func Test_PortInUseUDP(t *testing.T) {
+	assert.False(t, portInUse("udp", "127.0.0.1", 7000))
+	pc, err := net.ListenPacket("udp", "127.0.0.1:7000")
+	assert.NoError(t, err)
+	assert.True(t, portInUse("udp", "127.0.0.1", 7000))
+	assert.False(t, portInUse("tcp", "127.0.0.1", 7000))
+	assert.NoError(t, pc.Close())
+	assert.False(t, portInUse("udp", "127.0.0.1", 7000))
+}
+
+func Test_PortInUseHost(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:7000")
+	require.NoError(t, err)
+	defer l.Close()
+	assert.True(t, portInUse("tcp", "::1", 7000))
+	assert.False(t, portInUse("tcp", "127.0.0.1", 7000))
+}
+
 func Test_SubprocessManagerListen(t *testing.T) {
 	sm := &SubprocessManager{
 		Command:                []string{"nc", "-lk", "127.0.0.1", "7000"},
@@ -116,3 +159,22 @@ func Test_SubprocessManagerListenTimeout(t *testing.T) {
 	assert.NoError(t, err)
 	assertPortBound(t, 7000, false)
 }
+
+func Test_SubprocessManagerDirAndEnv(t *testing.T) {
+	dir := t.TempDir()
+	sm := &SubprocessManager{
+		Command:                []string{"bash", "-c", `echo "$(pwd) $FOO $HOME" > output.txt`},
+		Dir:                    dir,
+		Env:                    []string{"FOO=bar"},
+		TerminationGracePeriod: 100 * time.Millisecond,
+	}
+	err := sm.EnsureStarted()
+	assert.NoError(t, err)
+	time.Sleep(200 * time.Millisecond)
+	err = sm.EnsureStopped()
+	assert.NoError(t, err)
+	output, err := os.ReadFile(dir + "/output.txt")
+	assert.NoError(t, err)
+	// HOME should not be inherited
+	assert.Equal(t, dir+" bar \n", string(output))
+}
@@ -0,0 +1,123 @@
+package sleepingd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd, see
+// sd_listen_fds(3).
+const listenFDsStart = 3
+
+var (
+	activationOnce sync.Once
+	// activationFiles maps the names of the sockets passed by
+	// systemd to the files for them. It is populated on first
+	// use, and the files are kept open for the lifetime of the
+	// process, so that listeners can be created from them again
+	// after being closed, e.g. when reloading configuration.
+	activationFiles map[string][]*os.File
+)
+
+// parseListenFDs implements the socket activation protocol of
+// sd_listen_fds(3). Given the values of LISTEN_PID, LISTEN_FDS, and
+// LISTEN_FDNAMES, and the pid of the current process, it returns a
+// map from socket names to file descriptors. Sockets without a name
+// are called "unknown", as by systemd. If the variables were not
+// meant for the current process, then nil is returned.
+func parseListenFDs(listenPID string, listenFDs string, listenFDNames string, pid int) (map[string][]int, error) {
+	if listenPID == "" || listenFDs == "" {
+		return nil, nil
+	}
+	if target, err := strconv.Atoi(listenPID); err != nil || target != pid {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(listenFDs)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", listenFDs)
+	}
+	names := []string{}
+	if listenFDNames != "" {
+		names = strings.Split(listenFDNames, ":")
+	}
+	fds := map[string][]int{}
+	for i := range count {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		fds[name] = append(fds[name], listenFDsStart+i)
+	}
+	return fds, nil
+}
+
+// loadActivationFiles reads the sockets passed by systemd, if any,
+// into activationFiles. The environment variables are removed
+// afterwards so that they are not inherited by subprocesses, and the
+// file descriptors are marked close-on-exec for the same reason.
+func loadActivationFiles() {
+	activationOnce.Do(func() {
+		fds, err := parseListenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), os.Getpid())
+		LogError(err)
+		for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			_ = os.Unsetenv(name)
+		}
+		activationFiles = map[string][]*os.File{}
+		for name, nameFDs := range fds {
+			for _, fd := range nameFDs {
+				syscall.CloseOnExec(fd)
+				activationFiles[name] = append(activationFiles[name], os.NewFile(uintptr(fd), name))
+			}
+		}
+	})
+}
+
+// activationFile returns the file for the socket with the given name
+// that was passed by systemd.
+func activationFile(name string) (*os.File, error) {
+	loadActivationFiles()
+	files := activationFiles[name]
+	switch len(files) {
+	case 0:
+		return nil, fmt.Errorf("no socket named %s was passed by systemd (see FileDescriptorName= in systemd.socket(5))", name)
+	case 1:
+		return files[0], nil
+	default:
+		return nil, fmt.Errorf("systemd passed %d sockets named %s, expected one", len(files), name)
+	}
+}
+
+// ActivationListener returns a listener for the stream socket with
+// the given name that was passed by systemd with socket activation.
+// Closing the listener does not close the socket itself, so
+// ActivationListener can be called again for the same name later.
+func ActivationListener(name string) (net.Listener, error) {
+	f, err := activationFile(name)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket %s from systemd: %w", name, err)
+	}
+	return l, nil
+}
+
+// ActivationPacketConn is like ActivationListener, but for datagram
+// sockets.
+func ActivationPacketConn(name string) (net.PacketConn, error) {
+	f, err := activationFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket %s from systemd: %w", name, err)
+	}
+	return pc, nil
+}
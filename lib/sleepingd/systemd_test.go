@@ -0,0 +1,90 @@
+package sleepingd
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseListenFDs(t *testing.T) {
+	fds, err := parseListenFDs("123", "3", "web:dns", 123)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]int{"web": {3}, "dns": {4}, "unknown": {5}}, fds)
+	fds, err = parseListenFDs("123", "2", "", 123)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]int{"unknown": {3, 4}}, fds)
+	// Meant for another process
+	fds, err = parseListenFDs("456", "2", "web:dns", 123)
+	assert.NoError(t, err)
+	assert.Nil(t, fds)
+	fds, err = parseListenFDs("", "", "", 123)
+	assert.NoError(t, err)
+	assert.Nil(t, fds)
+	_, err = parseListenFDs("123", "many", "", 123)
+	assert.Error(t, err)
+}
+
+// setActivationFiles pretends that systemd passed the given files.
+func setActivationFiles(t *testing.T, files map[string][]*os.File) {
+	activationOnce.Do(func() {})
+	activationFiles = files
+	t.Cleanup(func() {
+		activationFiles = nil
+	})
+}
+
+func Test_ActivationListener(t *testing.T) {
+	echoserver := getEchoserver(t, "tcp", "127.0.0.1:7000")
+	defer echoserver.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+	defer f.Close()
+	setActivationFiles(t, map[string][]*os.File{"web": {f}})
+	_, err = ActivationListener("other")
+	assert.Error(t, err)
+	// Closing the proxy leaves the socket open, so it can be
+	// used again
+	for range 2 {
+		l, err := ActivationListener("web")
+		require.NoError(t, err)
+		proxy, err := NewProxy(&ProxyOptions{
+			Protocol:     "tcp",
+			UpstreamAddr: "127.0.0.1:7000",
+			Listener:     l,
+		})
+		require.NoError(t, err)
+		conn, err := net.Dial("tcp", "127.0.0.1:7001")
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		buf := make([]byte, 5)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		_, err = io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+		conn.Close()
+		require.NoError(t, proxy.Close())
+	}
+}
+
+func Test_ActivationPacketConn(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	f, err := pc.(*net.UDPConn).File()
+	require.NoError(t, err)
+	require.NoError(t, pc.Close())
+	defer f.Close()
+	setActivationFiles(t, map[string][]*os.File{"dns": {f}})
+	pc, err = ActivationPacketConn("dns")
+	require.NoError(t, err)
+	defer pc.Close()
+	assert.Equal(t, "127.0.0.1:7001", pc.LocalAddr().String())
+}
@@ -53,6 +53,30 @@ func (dms *DeadMansSwitch) Ping() {
 	dms.lock.Unlock()
 }
 
+// SetTimeout changes the timeout after which the callback is invoked.
+// If the timer is running, then the new timeout takes effect
+// relative to the most recent Ping.
+func (dms *DeadMansSwitch) SetTimeout(timeout time.Duration) {
+	dms.lock.Lock()
+	dms.timeout = timeout
+	dms.lock.Unlock()
+}
+
+// Remaining returns the time left until the callback is invoked, and
+// true, if the timer is running. Otherwise it returns false.
+func (dms *DeadMansSwitch) Remaining() (time.Duration, bool) {
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+	if !dms.active {
+		return 0, false
+	}
+	remaining := dms.timeout - time.Since(dms.lastPing)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, true
+}
+
 func (dms *DeadMansSwitch) check() {
 	dms.lock.Lock()
 	if dms.active && time.Now().Sub(dms.lastPing) >= dms.timeout {
@@ -168,3 +168,30 @@ func Test_DeadMansSwitchDeadlock(t *testing.T) {
 	s.Ping()
 	s.Ping() // this should return successfully, and not deadlock
 }
+
+func Test_DeadMansSwitchSetTimeout(t *testing.T) {
+	expireCh := make(chan struct{}, 1)
+	s := NewDeadMansSwitch(time.Hour, 10*time.Millisecond, func() {
+		expireCh <- struct{}{}
+	})
+	s.Ping()
+	// Shortening the timeout should take effect without another
+	// ping.
+	s.SetTimeout(100 * time.Millisecond)
+	select {
+	case <-expireCh:
+		// proceed
+	case <-time.NewTimer(300 * time.Millisecond).C:
+		assert.Fail(t, "dead man's switch never fired")
+	}
+}
+
+func Test_DeadMansSwitchRemaining(t *testing.T) {
+	s := NewDeadMansSwitch(time.Hour, 10*time.Millisecond, func() {})
+	_, ok := s.Remaining()
+	assert.False(t, ok)
+	s.Ping()
+	remaining, ok := s.Remaining()
+	assert.True(t, ok)
+	assert.InDelta(t, time.Hour, remaining, float64(time.Second))
+}
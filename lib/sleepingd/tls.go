@@ -0,0 +1,100 @@
+package sleepingd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader loads a TLS certificate and key from files, and loads
+// them again whenever either file changes, so that renewed
+// certificates are picked up without restarting sleepingd.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+// newCertReloader returns a certReloader for the given files,
+// returning an error if they cannot be loaded initially.
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload must be called with the lock held, except in the
+// constructor.
+func (cr *certReloader) reload() error {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return err
+	}
+	if cr.cert != nil && certInfo.ModTime().Equal(cr.certTime) && keyInfo.ModTime().Equal(cr.keyTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate %s: %w", cr.certFile, err)
+	}
+	if cr.cert != nil {
+		Log("reloaded TLS certificate %s", cr.certFile)
+	}
+	cr.cert = &cert
+	cr.certTime = certInfo.ModTime()
+	cr.keyTime = keyInfo.ModTime()
+	return nil
+}
+
+// GetCertificate is used for tls.Config.GetCertificate. If the files
+// have changed but cannot be loaded, e.g. because only one of them
+// has been replaced so far, then the previous certificate is used.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	LogError(cr.reload())
+	return cr.cert, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfig returns the configuration for terminating TLS with the
+// certificate and key in the given files, which are reloaded when
+// they change. minVersion is the minimum TLS version, e.g. "1.2", and
+// alpn lists the protocols to offer with ALPN, e.g. "h2", in order of
+// preference.
+func NewTLSConfig(certFile string, keyFile string, minVersion string, alpn []string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS version %q", minVersion)
+	}
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     version,
+		NextProtos:     alpn,
+	}, nil
+}
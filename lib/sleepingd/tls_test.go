@@ -0,0 +1,152 @@
+package sleepingd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 with
+// the given common name to the given files, with the given
+// modification time.
+func writeTestCert(t *testing.T, certFile string, keyFile string, commonName string, mtime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	require.NoError(t, os.Chtimes(certFile, mtime, mtime))
+	require.NoError(t, os.Chtimes(keyFile, mtime, mtime))
+}
+
+func Test_CertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	_, err := newCertReloader(certFile, keyFile)
+	assert.Error(t, err)
+	writeTestCert(t, certFile, keyFile, "first", time.Now().Add(-time.Minute))
+	cr, err := newCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	cert, err := cr.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "first", cert.Leaf.Subject.CommonName)
+	writeTestCert(t, certFile, keyFile, "second", time.Now())
+	cert, err = cr.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second", cert.Leaf.Subject.CommonName)
+	// Broken files are ignored until fixed
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0o600))
+	cert, err = cr.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second", cert.Leaf.Subject.CommonName)
+}
+
+func Test_Proxy_TLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "test", time.Now())
+	tlsConfig, err := NewTLSConfig(certFile, keyFile, "1.3", []string{"echo"})
+	require.NoError(t, err)
+	echoserver := getEchoserver(t, "tcp", "127.0.0.1:7000")
+	defer echoserver.Close()
+	numConns := &atomic.Int32{}
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:     "tcp",
+		ListenAddr:   "127.0.0.1:7001",
+		UpstreamAddr: "127.0.0.1:7000",
+		NewConnectionCallback: func() error {
+			numConns.Add(1)
+			return nil
+		},
+		TLS: tlsConfig,
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	conn, err := tls.Dial("tcp", "127.0.0.1:7001", &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"echo"},
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+	// Handshake is done without waking the upstream
+	assert.Equal(t, "echo", conn.ConnectionState().NegotiatedProtocol)
+	assert.Equal(t, uint16(tls.VersionTLS13), conn.ConnectionState().Version)
+	assert.Zero(t, numConns.Load())
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	assert.Equal(t, int32(1), numConns.Load())
+	// Old versions are refused
+	_, err = tls.Dial("tcp", "127.0.0.1:7001", &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+	})
+	assert.Error(t, err)
+}
+
+func Test_HTTPProxy_TLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "test", time.Now())
+	tlsConfig, err := NewTLSConfig(certFile, keyFile, "1.2", []string{"h2", "http/1.1"})
+	require.NoError(t, err)
+	start, ready := getHTTPUpstream(t, 0)
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:              "tcp",
+		ListenAddr:            "127.0.0.1:7001",
+		UpstreamAddr:          "127.0.0.1:7000",
+		NewConnectionCallback: start,
+		ReadyCallback:         ready,
+		TLS:                   tlsConfig,
+		HTTP:                  &HTTPOptions{WakeTimeout: time.Second},
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	res, err := client.Get("https://127.0.0.1:7001/")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 2, res.ProtoMajor)
+	assert.Equal(t, "forwarded for 127.0.0.1", string(body))
+}
@@ -0,0 +1,234 @@
+package sleepingd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultUDPSessionTimeout is used for ProxyOptions.SessionTimeout if
+// it is not set.
+const DefaultUDPSessionTimeout = 60 * time.Second
+
+// DefaultUDPSessionBuffer is used for ProxyOptions.SessionBuffer if
+// it is not set.
+const DefaultUDPSessionBuffer = 64
+
+// udpSession tracks the datagrams exchanged between one client
+// address and the upstream server. Each session has its own socket
+// connected to the upstream address, so that replies can be routed
+// back to the right client.
+type udpSession struct {
+	clientAddr net.Addr
+	// packets holds datagrams from the client that have not yet
+	// been forwarded upstream, e.g. because the upstream is still
+	// starting.
+	packets chan []byte
+	done    chan struct{}
+	dms     *DeadMansSwitch
+
+	lock      sync.Mutex
+	upstream  net.Conn
+	closeOnce sync.Once
+}
+
+func (s *udpSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.lock.Lock()
+		if s.upstream != nil {
+			_ = s.upstream.Close()
+		}
+		s.lock.Unlock()
+	})
+}
+
+// setUpstream records the upstream connection for the session, and
+// returns false if the session has already been closed, in which case
+// the caller should close the connection itself.
+func (s *udpSession) setUpstream(upstream net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	s.upstream = upstream
+	return true
+}
+
+func newUDPProxy(opts *ProxyOptions) (*Proxy, error) {
+	pc := opts.PacketConn
+	if pc == nil {
+		var err error
+		pc, err = net.ListenPacket(opts.Protocol, opts.ListenAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p := &Proxy{
+		packetConn:       pc,
+		upstreamProtocol: opts.upstreamProtocol(),
+		upstreamAddr:     opts.UpstreamAddr,
+		sessions:         map[string]*udpSession{},
+		sessionTimeout:   opts.SessionTimeout,
+	}
+	if p.sessionTimeout <= 0 {
+		p.sessionTimeout = DefaultUDPSessionTimeout
+	}
+	go p.serveUDP(opts)
+	return p, nil
+}
+
+func (p *Proxy) serveUDP(opts *ProxyOptions) {
+	buf := make([]byte, 64*1024)
+	for {
+		nr, addr, err := p.packetConn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			// Proxy was closed, stop accepting
+			// datagrams and tear down all sessions.
+			p.lock.Lock()
+			for _, s := range p.sessions {
+				s.close()
+			}
+			p.lock.Unlock()
+			return
+		} else if err != nil {
+			continue
+		}
+		if !opts.ConnectFrom.Allows(addr) {
+			continue
+		}
+		packet := make([]byte, nr)
+		copy(packet, buf[:nr])
+		s := p.getUDPSession(addr, opts)
+		s.dms.Ping()
+		select {
+		case s.packets <- packet:
+		default:
+			// Buffer is full, drop the datagram, as
+			// would happen on any congested network.
+		}
+	}
+}
+
+// getUDPSession returns the session for the given client address,
+// creating it if it does not exist yet.
+func (p *Proxy) getUDPSession(addr net.Addr, opts *ProxyOptions) *udpSession {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if s, ok := p.sessions[addr.String()]; ok {
+		return s
+	}
+	timeout := p.sessionTimeout
+	bufSize := opts.SessionBuffer
+	if bufSize <= 0 {
+		bufSize = DefaultUDPSessionBuffer
+	}
+	s := &udpSession{
+		clientAddr: addr,
+		packets:    make(chan []byte, bufSize),
+		done:       make(chan struct{}),
+	}
+	s.dms = NewDeadMansSwitch(timeout, min(timeout/10, time.Second), s.close)
+	p.sessions[addr.String()] = s
+	go p.runUDPSession(s, opts)
+	return s
+}
+
+// runUDPSession wakes the upstream if needed, then forwards datagrams
+// in both directions until the session is closed, either because it
+// was idle for too long or because the upstream went away.
+func (p *Proxy) runUDPSession(s *udpSession, opts *ProxyOptions) {
+	defer func() {
+		s.close()
+		p.lock.Lock()
+		if p.sessions[s.clientAddr.String()] == s {
+			delete(p.sessions, s.clientAddr.String())
+		}
+		p.lock.Unlock()
+	}()
+	if err := wakeUpstream(context.Background(), opts, s.clientAddr); err != nil {
+		if !wakeErrorIsExpected(err) {
+			LogError(err)
+		}
+		return
+	}
+	protocol, addr := p.Upstream()
+	upstream, err := net.Dial(protocol, addr)
+	if err != nil {
+		LogError(err)
+		return
+	}
+	if !s.setUpstream(upstream) {
+		_ = upstream.Close()
+		return
+	}
+	keepAwake := opts.KeepAwakeFrom.Allows(s.clientAddr)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			nr, err := upstream.Read(buf)
+			if err != nil {
+				// Either the session was closed, or
+				// the upstream is not listening
+				// anymore (connection refused).
+				s.close()
+				return
+			}
+			if opts.DataCallback != nil && keepAwake {
+				opts.DataCallback()
+			}
+			s.dms.Ping()
+			_, _ = p.packetConn.WriteTo(buf[:nr], s.clientAddr)
+		}
+	}()
+	for {
+		select {
+		case packet := <-s.packets:
+			// Datagrams only count as activity once they
+			// are forwarded, so that clients that may not
+			// wake the upstream do not keep it awake
+			// either while it is asleep.
+			if opts.DataCallback != nil && keepAwake {
+				opts.DataCallback()
+			}
+			if _, err := upstream.Write(packet); err != nil {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// CloseSessions closes all UDP sessions, so that the next datagram
+// from each client wakes the upstream again rather than being sent to
+// a socket that nothing is listening on anymore. It should be called
+// when the upstream is stopped. It does nothing in other modes.
+func (p *Proxy) CloseSessions() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for key, s := range p.sessions {
+		s.close()
+		delete(p.sessions, key)
+	}
+}
+
+// numSessions returns the number of active UDP sessions.
+func (p *Proxy) numSessions() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.sessions)
+}
+
+// SetSessionTimeout changes ProxyOptions.SessionTimeout. Sessions
+// that already exist keep their previous timeout.
+func (p *Proxy) SetSessionTimeout(timeout time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.sessionTimeout = timeout
+}
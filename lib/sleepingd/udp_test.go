@@ -0,0 +1,219 @@
+package sleepingd
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getUDPEchoserver(t *testing.T, addr string) net.PacketConn {
+	pc, err := net.ListenPacket("udp", addr)
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			nr, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:nr], addr)
+		}
+	}()
+	return pc
+}
+
+func readDatagram(t *testing.T, conn net.Conn) string {
+	buf := make([]byte, 1024)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	nr, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:nr])
+}
+
+func Test_Proxy_UDP(t *testing.T) {
+	echoserver := getUDPEchoserver(t, "127.0.0.1:7000")
+	defer echoserver.Close()
+	numConns := 0
+	numData := 0
+	lock := &sync.Mutex{}
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:     "udp",
+		ListenAddr:   "127.0.0.1:7001",
+		UpstreamAddr: "127.0.0.1:7000",
+		NewConnectionCallback: func() error {
+			lock.Lock()
+			defer lock.Unlock()
+			numConns += 1
+			return nil
+		},
+		DataCallback: func() {
+			lock.Lock()
+			defer lock.Unlock()
+			numData += 1
+		},
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("udp", "127.0.0.1:7001")
+		require.NoError(t, err)
+		defer conn.Close()
+		for j := 0; j < 3; j++ {
+			message := fmt.Sprintf("client %d message %d", i, j)
+			_, err = conn.Write([]byte(message))
+			require.NoError(t, err)
+			assert.Equal(t, message, readDatagram(t, conn))
+		}
+	}
+	assert.Equal(t, 2, proxy.numSessions())
+	lock.Lock()
+	defer lock.Unlock()
+	// One session per client address.
+	assert.Equal(t, 2, numConns)
+	// Both directions count as activity.
+	assert.Equal(t, 12, numData)
+}
+
+func Test_Proxy_UDPSessionExpiry(t *testing.T) {
+	echoserver := getUDPEchoserver(t, "127.0.0.1:7000")
+	defer echoserver.Close()
+	numConns := 0
+	lock := &sync.Mutex{}
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:     "udp",
+		ListenAddr:   "127.0.0.1:7001",
+		UpstreamAddr: "127.0.0.1:7000",
+		NewConnectionCallback: func() error {
+			lock.Lock()
+			defer lock.Unlock()
+			numConns += 1
+			return nil
+		},
+		SessionTimeout: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	conn, err := net.Dial("udp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readDatagram(t, conn))
+	assert.Equal(t, 1, proxy.numSessions())
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, 0, proxy.numSessions())
+	// A new session is started for the next datagram.
+	_, err = conn.Write([]byte("hello again"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello again", readDatagram(t, conn))
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, 2, numConns)
+}
+
+func Test_Proxy_UDPCloseSessions(t *testing.T) {
+	echoserver := getUDPEchoserver(t, "127.0.0.1:7000")
+	numConns := &atomic.Int32{}
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:     "udp",
+		ListenAddr:   "127.0.0.1:7001",
+		UpstreamAddr: "127.0.0.1:7000",
+		NewConnectionCallback: func() error {
+			numConns.Add(1)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	conn, err := net.Dial("udp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readDatagram(t, conn))
+	// The upstream is stopped and started again, which
+	// invalidates the session's socket.
+	echoserver.Close()
+	proxy.CloseSessions()
+	assert.Equal(t, 0, proxy.numSessions())
+	echoserver = getUDPEchoserver(t, "127.0.0.1:7000")
+	defer echoserver.Close()
+	_, err = conn.Write([]byte("hello again"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello again", readDatagram(t, conn))
+	assert.Equal(t, int32(2), numConns.Load())
+}
+
+func Test_Proxy_UDPBufferWhileWaking(t *testing.T) {
+	var echoserver net.PacketConn
+	defer func() {
+		if echoserver != nil {
+			echoserver.Close()
+		}
+	}()
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:     "udp",
+		ListenAddr:   "127.0.0.1:7001",
+		UpstreamAddr: "127.0.0.1:7000",
+		NewConnectionCallback: func() error {
+			// Simulate an application that takes a
+			// while to start up.
+			time.Sleep(200 * time.Millisecond)
+			echoserver = getUDPEchoserver(t, "127.0.0.1:7000")
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	conn, err := net.Dial("udp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		_, err = conn.Write(fmt.Appendf(nil, "message %d", i))
+		require.NoError(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, fmt.Sprintf("message %d", i), readDatagram(t, conn))
+	}
+}
+
+func Test_Proxy_UDPClientRules(t *testing.T) {
+	echoserver := getUDPEchoserver(t, "127.0.0.1:7000")
+	defer echoserver.Close()
+	wakeFrom, err := ParseClientRules([]string{"!127.0.0.1"})
+	require.NoError(t, err)
+	numConns := &atomic.Int32{}
+	numData := &atomic.Int32{}
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:     "udp",
+		ListenAddr:   "127.0.0.1:7001",
+		UpstreamAddr: "127.0.0.1:7000",
+		NewConnectionCallback: func() error {
+			numConns.Add(1)
+			return nil
+		},
+		ReadyCallback: func() bool { return false },
+		DataCallback:  func() { numData.Add(1) },
+		WakeFrom:      wakeFrom,
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	conn, err := net.Dial("udp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	// The client may not wake the upstream, so its datagrams
+	// do not keep it awake either.
+	assert.Zero(t, numConns.Load())
+	assert.Zero(t, numData.Load())
+}
@@ -0,0 +1,117 @@
+package sleepingd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// removeStaleSocket removes the Unix domain socket at path if nothing
+// is listening on it, e.g. because the process that created it
+// crashed. It returns an error if something is still listening.
+// Nothing happens if there is no socket at the path.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("something is already listening on %s", path)
+	}
+	return os.Remove(path)
+}
+
+// listenUnix listens on a Unix domain socket at path, first removing
+// any stale socket there. If mode is non-zero, then the permissions
+// of the socket are set to it. If owner is non-empty, then the
+// ownership of the socket is changed, see parseOwner.
+func listenUnix(path string, mode os.FileMode, owner string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketPermissions(path, mode, owner); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// setSocketPermissions changes the mode and ownership of the socket
+// at path, see listenUnix.
+func setSocketPermissions(path string, mode os.FileMode, owner string) error {
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if owner != "" {
+		uid, gid, err := parseOwner(owner)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseOwner parses an owner in the format "user", "user:group", or
+// ":group", where the user and group are names or numeric IDs. It
+// returns -1 for the user or group if it is not given, as accepted by
+// os.Chown.
+func parseOwner(owner string) (int, int, error) {
+	userName, groupName, _ := strings.Cut(owner, ":")
+	uid, gid := -1, -1
+	if userName != "" {
+		if id, err := strconv.Atoi(userName); err == nil {
+			uid = id
+		} else {
+			u, err := user.Lookup(userName)
+			if err != nil {
+				return 0, 0, err
+			}
+			uid, err = strconv.Atoi(u.Uid)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	if groupName != "" {
+		if id, err := strconv.Atoi(groupName); err == nil {
+			gid = id
+		} else {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return 0, 0, err
+			}
+			gid, err = strconv.Atoi(g.Gid)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// ParseSocketMode parses permissions for a Unix domain socket given
+// as an octal string, e.g. "0660". The empty string is parsed as
+// zero, meaning that the permissions should not be changed.
+func ParseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || n > 0o777 {
+		return 0, fmt.Errorf("invalid socket mode %q, expected octal permissions like 0660", mode)
+	}
+	return os.FileMode(n), nil
+}
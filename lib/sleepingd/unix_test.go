@@ -0,0 +1,84 @@
+package sleepingd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "stale.sock")
+	// Nothing there yet
+	assert.NoError(t, removeStaleSocket(stale))
+	l, err := net.Listen("unix", stale)
+	require.NoError(t, err)
+	// Leave the socket file behind when closing, as would happen
+	// if the process crashed
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, l.Close())
+	_, err = os.Lstat(stale)
+	require.NoError(t, err)
+	assert.NoError(t, removeStaleSocket(stale))
+	_, err = os.Lstat(stale)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	active := filepath.Join(dir, "active.sock")
+	l, err = net.Listen("unix", active)
+	require.NoError(t, err)
+	defer l.Close()
+	assert.ErrorContains(t, removeStaleSocket(active), "something is already listening")
+}
+
+func Test_ListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sock")
+	l, err := listenUnix(path, 0o640, "")
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	// Changing the group to one we are already in is always
+	// allowed, even without root
+	assert.NoError(t, setSocketPermissions(path, 0o600, ":"+strconv.Itoa(os.Getgid())))
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	require.NoError(t, l.Close())
+	_, err = os.Lstat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func Test_ParseOwner(t *testing.T) {
+	uid, gid, err := parseOwner("1000")
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, uid)
+	assert.Equal(t, -1, gid)
+	uid, gid, err = parseOwner("1000:33")
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, uid)
+	assert.Equal(t, 33, gid)
+	uid, gid, err = parseOwner(":33")
+	assert.NoError(t, err)
+	assert.Equal(t, -1, uid)
+	assert.Equal(t, 33, gid)
+	uid, _, err = parseOwner("root")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, uid)
+	_, _, err = parseOwner("no-such-user-hopefully")
+	assert.Error(t, err)
+}
+
+func Test_ParseSocketMode(t *testing.T) {
+	mode, err := ParseSocketMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0), mode)
+	mode, err = ParseSocketMode("0660")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o660), mode)
+	_, err = ParseSocketMode("999")
+	assert.Error(t, err)
+}
@@ -0,0 +1,137 @@
+package sleepingd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	wakeQueuePending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sleepingd_wake_queue_pending",
+		Help: "Number of connections waiting for an application to wake up, including those that gave up until the wake-up finishes.",
+	}, []string{"app"})
+	wakeQueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sleepingd_wake_queue_wait_seconds",
+		Help:    "Time that connections waited for an application to wake up, including those that gave up.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"app"})
+	wakeQueueRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sleepingd_wake_queue_rejected_total",
+		Help: "Number of connections rejected while an application was waking up, by reason (full or timeout).",
+	}, []string{"app", "reason"})
+)
+
+var (
+	// errWakeQueueFull is returned by WakeQueue.Wake if too many
+	// connections are already waiting.
+	errWakeQueueFull = errors.New("too many connections waiting for the application to wake up")
+	// errWakeTimeout is returned by WakeQueue.Wake if the
+	// upstream did not wake up in time.
+	errWakeTimeout = errors.New("timed out waiting for the application to wake up")
+)
+
+// WakeQueue limits the number of connections that wait for an
+// upstream to wake up, and how long they wait, see NewWakeQueue. A
+// nil *WakeQueue has no limits.
+type WakeQueue struct {
+	name string
+
+	// lock must be held to access maxPending, maxWait, or
+	// pending.
+	lock       sync.Mutex
+	maxPending int
+	maxWait    time.Duration
+	pending    int
+}
+
+// NewWakeQueue returns a queue that allows up to maxPending
+// connections to wait for up to maxWait each, see WakeQueue.Wake.
+// Zero means no limit for either one. The name is used to label
+// metrics.
+func NewWakeQueue(name string, maxPending int, maxWait time.Duration) *WakeQueue {
+	return &WakeQueue{
+		name:       name,
+		maxPending: maxPending,
+		maxWait:    maxWait,
+	}
+}
+
+// SetLimits changes the limits of the queue, without affecting
+// connections that are already waiting.
+func (q *WakeQueue) SetLimits(maxPending int, maxWait time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.maxPending = maxPending
+	q.maxWait = maxWait
+}
+
+// Wake calls wake, which should start the upstream and return once it
+// is ready, and waits for it to return, returning its error. If too
+// many connections are already waiting, then it returns
+// errWakeQueueFull without calling wake, since the upstream is
+// already being started. If wake does not return within the maximum
+// wait time, or before ctx is done, then an error is returned, and
+// wake continues in the background.
+func (q *WakeQueue) Wake(ctx context.Context, wake func() error) error {
+	if q == nil {
+		return waitFor(ctx, wake, nil)
+	}
+	q.lock.Lock()
+	if q.maxPending > 0 && q.pending >= q.maxPending {
+		q.lock.Unlock()
+		wakeQueueRejected.WithLabelValues(q.name, "full").Inc()
+		return errWakeQueueFull
+	}
+	q.pending++
+	maxWait := q.maxWait
+	q.lock.Unlock()
+	wakeQueuePending.WithLabelValues(q.name).Inc()
+	start := time.Now()
+	defer func() {
+		wakeQueueWait.WithLabelValues(q.name).Observe(time.Since(start).Seconds())
+	}()
+	var timeout <-chan time.Time
+	if maxWait > 0 {
+		timer := time.NewTimer(maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	err := waitFor(ctx, func() error {
+		err := wake()
+		// A connection that gave up waiting still counts as
+		// pending until here, so that the number of blocked
+		// goroutines is bounded too.
+		q.lock.Lock()
+		q.pending--
+		q.lock.Unlock()
+		wakeQueuePending.WithLabelValues(q.name).Dec()
+		return err
+	}, timeout)
+	if errors.Is(err, errWakeTimeout) {
+		wakeQueueRejected.WithLabelValues(q.name, "timeout").Inc()
+	}
+	return err
+}
+
+// waitFor runs f in the background, and waits for it to return, for
+// ctx to be done, or for timeout to fire, whichever comes first. In
+// the first case, the error from f is returned.
+func waitFor(ctx context.Context, f func() error, timeout <-chan time.Time) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-timeout:
+		return errWakeTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
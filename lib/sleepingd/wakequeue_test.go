@@ -0,0 +1,122 @@
+package sleepingd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WakeQueue(t *testing.T) {
+	q := NewWakeQueue("test", 2, 200*time.Millisecond)
+	release := make(chan struct{})
+	wake := func() error {
+		<-release
+		return nil
+	}
+	errs := make(chan error, 3)
+	for range 2 {
+		go func() {
+			errs <- q.Wake(context.Background(), wake)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	// Both slots are taken
+	err := q.Wake(context.Background(), wake)
+	assert.ErrorIs(t, err, errWakeQueueFull)
+	// Rejections are counted by the metrics rather than logged
+	assert.True(t, wakeErrorIsExpected(err))
+	err = <-errs
+	assert.ErrorIs(t, err, errWakeTimeout)
+	assert.True(t, wakeErrorIsExpected(err))
+	assert.ErrorIs(t, <-errs, errWakeTimeout)
+	// Connections that gave up still count until the wake-up
+	// finishes
+	assert.ErrorIs(t, q.Wake(context.Background(), wake), errWakeQueueFull)
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, q.Wake(context.Background(), wake))
+	// Limits can be lifted
+	q.SetLimits(0, 0)
+	assert.NoError(t, q.Wake(context.Background(), func() error {
+		time.Sleep(300 * time.Millisecond)
+		return nil
+	}))
+	// No limits at all
+	var nilQueue *WakeQueue
+	assert.NoError(t, nilQueue.Wake(context.Background(), func() error { return nil }))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, nilQueue.Wake(ctx, func() error {
+		time.Sleep(time.Second)
+		return nil
+	}), context.DeadlineExceeded)
+}
+
+func Test_Proxy_WakeQueueFull(t *testing.T) {
+	echoserver := getEchoserver(t, "tcp", "127.0.0.1:7000")
+	defer echoserver.Close()
+	release := make(chan struct{})
+	defer close(release)
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:     "tcp",
+		ListenAddr:   "127.0.0.1:7001",
+		UpstreamAddr: "127.0.0.1:7000",
+		NewConnectionCallback: func() error {
+			<-release
+			return nil
+		},
+		ReadyCallback: func() bool { return false },
+		WakeQueue:     NewWakeQueue("test", 1, 0),
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	waiting, err := net.Dial("tcp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	defer waiting.Close()
+	_, err = waiting.Write([]byte("hello"))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	// Over the limit, so reset
+	conn, err := net.Dial("tcp", "127.0.0.1:7001")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, syscall.ECONNRESET), "expected reset, got %v", err)
+}
+
+func Test_HTTPProxy_WakeQueueFull(t *testing.T) {
+	start, ready := getHTTPUpstream(t, 500*time.Millisecond)
+	proxy, err := NewProxy(&ProxyOptions{
+		Protocol:              "tcp",
+		ListenAddr:            "127.0.0.1:7001",
+		UpstreamAddr:          "127.0.0.1:7000",
+		NewConnectionCallback: start,
+		ReadyCallback:         ready,
+		WakeQueue:             NewWakeQueue("test", 1, 0),
+		HTTP: &HTTPOptions{
+			WakeTimeout: 2 * time.Second,
+			RetryAfter:  5 * time.Second,
+		},
+	})
+	require.NoError(t, err)
+	defer proxy.Close()
+	held := make(chan int)
+	go func() {
+		res, _ := httpGet(t, "http://127.0.0.1:7001/", "")
+		held <- res.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+	res, _ := httpGet(t, "http://127.0.0.1:7001/", "")
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, http.StatusOK, <-held)
+}
@@ -3,9 +3,11 @@ package cases
 import (
 	"bytes"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
@@ -178,3 +180,618 @@ func Test_Load(t *testing.T) {
 	assert.NotContains(t, sbOutput.String(), "fatal")
 	assert.NotContains(t, sbOutput.String(), "error")
 }
+
+func Test_MultipleApps(t *testing.T) {
+	sb := exec.Command("sleepingd")
+	sb.Env = append(
+		os.Environ(),
+		"SLEEPING_BEAUTY_APPS=first,second",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS=1",
+		"SLEEPING_BEAUTY_APP_FIRST_COMMAND=python3 -u -m http.server -b 127.0.0.1 -d / 6666",
+		"SLEEPING_BEAUTY_APP_FIRST_COMMAND_PORT=6666",
+		"SLEEPING_BEAUTY_APP_FIRST_LISTEN_PORT=4444",
+		"SLEEPING_BEAUTY_APP_SECOND_COMMAND=python3 -u -m http.server -b 127.0.0.1 -d / 6667",
+		"SLEEPING_BEAUTY_APP_SECOND_COMMAND_PORT=6667",
+		"SLEEPING_BEAUTY_APP_SECOND_LISTEN_PORT=4445",
+		"SLEEPING_BEAUTY_APP_SECOND_TIMEOUT_SECONDS=10",
+	)
+	sbStdout := bytes.Buffer{}
+	sb.Stdout = &sbStdout
+	sbStderr := bytes.Buffer{}
+	sb.Stderr = &sbStderr
+	assert.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	for _, port := range []string{"4444", "4445"} {
+		curl := exec.Command("curl", "-m5", "-sS", "http://127.0.0.1:"+port)
+		curlStdout := bytes.Buffer{}
+		curl.Stdout = &curlStdout
+		curlStderr := bytes.Buffer{}
+		curl.Stderr = &curlStderr
+		assert.NoError(t, curl.Run(), "stderr: %s", curlStderr.String())
+		assert.Contains(t, curlStdout.String(), "Directory listing")
+	}
+	time.Sleep(3 * time.Second)
+	// Only the first application should have timed out by now.
+	assert.Contains(t, sbStderr.String(), "[first] starting subprocess")
+	assert.Contains(t, sbStderr.String(), "[second] starting subprocess")
+	assert.Contains(t, sbStderr.String(), "[first] stopping subprocess")
+	assert.NotContains(t, sbStderr.String(), "[second] stopping subprocess")
+}
+
+func Test_Reload(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "sleepingd.yaml")
+	writeConfig := func(listenPort string) {
+		config := `apps:
+  - name: web
+    command: python3 -u -m http.server -b 127.0.0.1 -d / 6666
+    timeout_seconds: 10
+    command_port: 6666
+    listen_port: ` + listenPort + "\n"
+		require.NoError(t, os.WriteFile(configPath, []byte(config), 0o644))
+	}
+	writeConfig("4444")
+	sb := exec.Command("sleepingd", "--config", configPath)
+	sbOutput := bytes.Buffer{}
+	sb.Stdout = &sbOutput
+	sb.Stderr = &sbOutput
+	assert.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	curl := exec.Command("curl", "-m5", "-sS", "http://127.0.0.1:4444")
+	assert.NoError(t, curl.Run())
+	writeConfig("4445")
+	assert.NoError(t, sb.Process.Signal(syscall.SIGHUP))
+	time.Sleep(500 * time.Millisecond)
+	curl = exec.Command("curl", "-m5", "-sS", "http://127.0.0.1:4445")
+	curlStdout := bytes.Buffer{}
+	curl.Stdout = &curlStdout
+	assert.NoError(t, curl.Run())
+	assert.Contains(t, curlStdout.String(), "Directory listing")
+	curl = exec.Command("curl", "-m5", "-sS", "http://127.0.0.1:4444")
+	assert.Error(t, curl.Run(), "old listener should be closed")
+	// The application itself did not need to be restarted.
+	assert.Equal(t, 1, strings.Count(sbOutput.String(), "starting subprocess"))
+	assert.Contains(t, sbOutput.String(), "reloading configuration")
+	assert.NotContains(t, sbOutput.String(), "error")
+}
+
+func Test_ReloadSwapPorts(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"first", "second"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name, "name"), []byte(name), 0o644))
+	}
+	configPath := filepath.Join(dir, "sleepingd.yaml")
+	writeConfig := func(firstPort string, secondPort string) {
+		config := `apps:
+  - name: first
+    command: python3 -u -m http.server -b 127.0.0.1 -d ` + filepath.Join(dir, "first") + ` 6666
+    timeout_seconds: 10
+    command_port: 6666
+    listen_port: ` + firstPort + `
+  - name: second
+    command: python3 -u -m http.server -b 127.0.0.1 -d ` + filepath.Join(dir, "second") + ` 6667
+    timeout_seconds: 10
+    command_port: 6667
+    listen_port: ` + secondPort + "\n"
+		require.NoError(t, os.WriteFile(configPath, []byte(config), 0o644))
+	}
+	get := func(port string) string {
+		curl := exec.Command("curl", "-m5", "-sS", "http://127.0.0.1:"+port+"/name")
+		curlStdout := bytes.Buffer{}
+		curl.Stdout = &curlStdout
+		assert.NoError(t, curl.Run())
+		return curlStdout.String()
+	}
+	writeConfig("4444", "4445")
+	sb := exec.Command("sleepingd", "--config", configPath)
+	sbOutput := bytes.Buffer{}
+	sb.Stdout = &sbOutput
+	sb.Stderr = &sbOutput
+	require.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, "first", get("4444"))
+	assert.Equal(t, "second", get("4445"))
+	writeConfig("4445", "4444")
+	require.NoError(t, sb.Process.Signal(syscall.SIGHUP))
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, "second", get("4444"))
+	assert.Equal(t, "first", get("4445"))
+	assert.NotContains(t, sbOutput.String(), "error")
+}
+
+func Test_Control(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "control.sock")
+	sb := exec.Command("sleepingd")
+	sb.Env = append(
+		os.Environ(),
+		"SLEEPING_BEAUTY_COMMAND=python3 -u -m http.server -b 127.0.0.1 -d / 6666",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS=1",
+		"SLEEPING_BEAUTY_COMMAND_PORT=6666",
+		"SLEEPING_BEAUTY_LISTEN_PORT=4444",
+		"SLEEPING_BEAUTY_CONTROL_SOCKET="+socket,
+	)
+	sbOutput := bytes.Buffer{}
+	sb.Stdout = &sbOutput
+	sb.Stderr = &sbOutput
+	assert.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	ctl := func(args ...string) string {
+		cmd := exec.Command("sleepingd", append([]string{"ctl", "--socket", socket}, args...)...)
+		output, err := cmd.CombinedOutput()
+		assert.NoError(t, err, "output: %s", string(output))
+		return string(output)
+	}
+	assert.Contains(t, ctl("status"), "default  sleeping")
+	assert.Contains(t, ctl("wake"), "default  running")
+	ctl("pause")
+	// Should stay awake past the timeout while paused
+	time.Sleep(2500 * time.Millisecond)
+	assert.Contains(t, ctl("status"), "running (paused)")
+	assert.Contains(t, ctl("sleep"), "sleeping (paused)")
+	// Should not be woken by traffic while paused
+	curl := exec.Command("curl", "-m5", "-sS", "http://127.0.0.1:4444")
+	assert.Error(t, curl.Run())
+	ctl("resume")
+	curl = exec.Command("curl", "-m5", "-sS", "http://127.0.0.1:4444")
+	assert.NoError(t, curl.Run())
+	assert.Equal(t, 2, strings.Count(sbOutput.String(), "starting subprocess"))
+}
+
+func Test_ExecForm(t *testing.T) {
+	sb := exec.Command("sleepingd")
+	sb.Env = append(
+		os.Environ(),
+		`SLEEPING_BEAUTY_COMMAND=["python3", "-u", "-m", "http.server", "-b", "127.0.0.1", "-d", "/", "6666"]`,
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS=1",
+		"SLEEPING_BEAUTY_COMMAND_PORT=6666",
+		"SLEEPING_BEAUTY_LISTEN_PORT=4444",
+	)
+	sbOutput := bytes.Buffer{}
+	sb.Stdout = &sbOutput
+	sb.Stderr = &sbOutput
+	assert.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	curl := exec.Command("curl", "-m5", "-sS", "http://127.0.0.1:4444")
+	curlStdout := bytes.Buffer{}
+	curl.Stdout = &curlStdout
+	assert.NoError(t, curl.Run())
+	assert.Contains(t, curlStdout.String(), "Directory listing")
+	assert.Contains(t, sbOutput.String(), `with exec form command line: ["python3" "-u" "-m" "http.server" "-b" "127.0.0.1" "-d" "/" "6666"]`)
+}
+
+func Test_ListenHostIPv6(t *testing.T) {
+	sb := exec.Command("sleepingd")
+	sb.Env = append(
+		os.Environ(),
+		"SLEEPING_BEAUTY_COMMAND=python3 -u -m http.server -b 127.0.0.1 -d / 6666",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS=1",
+		"SLEEPING_BEAUTY_COMMAND_PORT=6666",
+		"SLEEPING_BEAUTY_LISTEN_HOST=::1",
+		"SLEEPING_BEAUTY_LISTEN_PORT=4444",
+	)
+	sbOutput := bytes.Buffer{}
+	sb.Stdout = &sbOutput
+	sb.Stderr = &sbOutput
+	assert.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	curl := exec.Command("curl", "-m5", "-sS", "http://[::1]:4444")
+	curlStdout := bytes.Buffer{}
+	curl.Stdout = &curlStdout
+	assert.NoError(t, curl.Run())
+	assert.Contains(t, curlStdout.String(), "Directory listing")
+	assert.Contains(t, sbOutput.String(), "listening on [::1]:4444, proxying to 127.0.0.1:6666")
+}
+
+func Test_UDP(t *testing.T) {
+	sb := exec.Command("sleepingd")
+	sb.Env = append(
+		os.Environ(),
+		`SLEEPING_BEAUTY_COMMAND=["python3", "-u", "-c", "import socket; s = socket.socket(socket.AF_INET, socket.SOCK_DGRAM); s.bind(('127.0.0.1', 6666))\nwhile True: data, addr = s.recvfrom(1024); s.sendto(data.upper(), addr)"]`,
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS=1",
+		"SLEEPING_BEAUTY_COMMAND_PORT=6666",
+		"SLEEPING_BEAUTY_LISTEN_PORT=4444",
+		"SLEEPING_BEAUTY_PROTOCOL=udp",
+	)
+	sbOutput := bytes.Buffer{}
+	sb.Stdout = &sbOutput
+	sb.Stderr = &sbOutput
+	assert.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	conn, err := net.Dial("udp", "127.0.0.1:4444")
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 1024)
+	nr, err := conn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "HELLO", string(buf[:nr]))
+	time.Sleep(2500 * time.Millisecond)
+	assert.Contains(t, sbOutput.String(), "listening on 0.0.0.0:4444 (udp)")
+	assert.Contains(t, sbOutput.String(), "stopping subprocess")
+	// The next datagram from the same client wakes the
+	// application again.
+	_, err = conn.Write([]byte("again"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	nr, err = conn.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "AGAIN", string(buf[:nr]))
+	assert.Equal(t, 2, strings.Count(sbOutput.String(), "starting subprocess"))
+}
+
+func Test_UnixSockets(t *testing.T) {
+	dir := t.TempDir()
+	commandSocket := filepath.Join(dir, "app.sock")
+	listenSocket := filepath.Join(dir, "sleepingd.sock")
+	sb := exec.Command("sleepingd")
+	sb.Env = append(
+		os.Environ(),
+		`SLEEPING_BEAUTY_COMMAND=["python3", "-u", "-c", "import http.server, socketserver, sys\nclass Handler(http.server.SimpleHTTPRequestHandler):\n  def address_string(self): return 'unix'\nsocketserver.UnixStreamServer(sys.argv[1], lambda *args: Handler(*args, directory='/')).serve_forever()", "`+commandSocket+`"]`,
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS=1",
+		"SLEEPING_BEAUTY_COMMAND_SOCKET="+commandSocket,
+		"SLEEPING_BEAUTY_LISTEN_SOCKET="+listenSocket,
+		"SLEEPING_BEAUTY_LISTEN_SOCKET_MODE=0660",
+	)
+	sbOutput := bytes.Buffer{}
+	sb.Stdout = &sbOutput
+	sb.Stderr = &sbOutput
+	assert.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	info, err := os.Stat(listenSocket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o660), info.Mode().Perm())
+	for range 2 {
+		curl := exec.Command("curl", "-m5", "-sS", "--unix-socket", listenSocket, "http://localhost/")
+		curlStdout := bytes.Buffer{}
+		curl.Stdout = &curlStdout
+		assert.NoError(t, curl.Run())
+		assert.Contains(t, curlStdout.String(), "Directory listing")
+		// Wait for the application to be put to sleep, which
+		// leaves a stale socket behind that has to be
+		// cleaned up before it can be woken again.
+		time.Sleep(2500 * time.Millisecond)
+	}
+	assert.Contains(t, sbOutput.String(), "listening on unix:"+listenSocket+", proxying to unix:"+commandSocket)
+	assert.Equal(t, 2, strings.Count(sbOutput.String(), "stopping subprocess"))
+}
+
+func Test_HTTPMode(t *testing.T) {
+	sb := exec.Command("sleepingd")
+	sb.Env = append(
+		os.Environ(),
+		"SLEEPING_BEAUTY_COMMAND=sleep 0.5 && python3 -u -m http.server -b 127.0.0.1 -d / 6666",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS=5",
+		"SLEEPING_BEAUTY_COMMAND_PORT=6666",
+		"SLEEPING_BEAUTY_LISTEN_PORT=4444",
+		"SLEEPING_BEAUTY_MODE=http",
+		"SLEEPING_BEAUTY_HTTP_WAKE_RESPONSE=immediate",
+		"SLEEPING_BEAUTY_HTTP_RETRY_AFTER_SECONDS=2",
+	)
+	sb.Stdout = os.Stdout
+	sb.Stderr = os.Stderr
+	assert.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err := client.Get("http://127.0.0.1:4444")
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, "2", res.Header.Get("Retry-After"))
+	time.Sleep(2 * time.Second)
+	res, err = client.Get("http://127.0.0.1:4444")
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, string(body), "Directory listing")
+}
+
+func Test_HostRouting(t *testing.T) {
+	sb := exec.Command("sleepingd")
+	sb.Env = append(
+		os.Environ(),
+		"SLEEPING_BEAUTY_APPS=first,second",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS=10",
+		"SLEEPING_BEAUTY_LISTEN_PORT=4444",
+		"SLEEPING_BEAUTY_APP_FIRST_COMMAND=python3 -u -m http.server -b 127.0.0.1 -d / 6666",
+		"SLEEPING_BEAUTY_APP_FIRST_COMMAND_PORT=6666",
+		"SLEEPING_BEAUTY_APP_FIRST_HOSTNAMES=first.test",
+		"SLEEPING_BEAUTY_APP_SECOND_COMMAND=python3 -u -m http.server -b 127.0.0.1 -d / 6667",
+		"SLEEPING_BEAUTY_APP_SECOND_COMMAND_PORT=6667",
+		"SLEEPING_BEAUTY_APP_SECOND_DEFAULT_ROUTE=true",
+	)
+	sbStderr := bytes.Buffer{}
+	sb.Stderr = &sbStderr
+	assert.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	get := func(host string) {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:4444", nil)
+		require.NoError(t, err)
+		req.Host = host
+		client := &http.Client{Timeout: 5 * time.Second}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		assert.NoError(t, err)
+		assert.Contains(t, string(body), "Directory listing")
+	}
+	get("first.test")
+	assert.Contains(t, sbStderr.String(), "[first] starting subprocess")
+	assert.NotContains(t, sbStderr.String(), "[second] starting subprocess")
+	get("other.test")
+	assert.Contains(t, sbStderr.String(), "[second] starting subprocess")
+}
+
+func Test_SocketActivation(t *testing.T) {
+	// Play the part of systemd: open the socket, and pass it to
+	// sleepingd as file descriptor 3. LISTEN_PID has to be the
+	// pid of sleepingd, which the shell keeps when it execs.
+	l, err := net.Listen("tcp", "127.0.0.1:4444")
+	require.NoError(t, err)
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	defer f.Close()
+	sb := exec.Command("sh", "-c", `LISTEN_PID=$$ exec sleepingd`)
+	sb.ExtraFiles = []*os.File{f}
+	sb.Env = append(
+		os.Environ(),
+		"LISTEN_FDS=1",
+		"LISTEN_FDNAMES=web",
+		"SLEEPING_BEAUTY_COMMAND=python3 -u -m http.server -b 127.0.0.1 -d / 6666",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS=5",
+		"SLEEPING_BEAUTY_COMMAND_PORT=6666",
+		"SLEEPING_BEAUTY_LISTEN_FD_NAME=web",
+	)
+	sb.Stdout = os.Stdout
+	sb.Stderr = os.Stderr
+	assert.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err := client.Get("http://127.0.0.1:4444")
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "Directory listing")
+}
+
+func Test_Handoff(t *testing.T) {
+	sb := exec.Command("sleepingd")
+	sb.Env = append(
+		os.Environ(),
+		`SLEEPING_BEAUTY_COMMAND=["python3", "-u", "../resources/activated.py", "1"]`,
+		"SLEEPING_BEAUTY_LISTEN_PORT=4444",
+		"SLEEPING_BEAUTY_MODE=handoff",
+	)
+	sbStderr := bytes.Buffer{}
+	sb.Stdout = os.Stdout
+	sb.Stderr = &sbStderr
+	assert.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	get := func() string {
+		client := &http.Client{Timeout: 5 * time.Second}
+		res, err := client.Get("http://127.0.0.1:4444")
+		require.NoError(t, err)
+		body, err := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		assert.NoError(t, err)
+		return string(body)
+	}
+	first := get()
+	assert.Contains(t, first, "pid ")
+	// Served by the same process, directly
+	assert.Equal(t, first, get())
+	// The application exits on its own, after which a new
+	// connection starts it again
+	time.Sleep(2 * time.Second)
+	assert.Contains(t, sbStderr.String(), "subprocess exited, listening again")
+	second := get()
+	assert.Contains(t, second, "pid ")
+	assert.NotEqual(t, first, second)
+}
+
+func Test_ExtraPorts(t *testing.T) {
+	sb := exec.Command("sleepingd")
+	sb.Env = append(
+		os.Environ(),
+		"SLEEPING_BEAUTY_COMMAND=python3 -u -m http.server -b 127.0.0.1 -d / 6666 & exec python3 -u -m http.server -b 127.0.0.1 -d / 6667",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS=2",
+		"SLEEPING_BEAUTY_COMMAND_PORT=6666",
+		"SLEEPING_BEAUTY_LISTEN_PORT=4444",
+		"SLEEPING_BEAUTY_EXTRA_PORTS=4445:6667",
+	)
+	sbStdout := bytes.Buffer{}
+	sb.Stdout = &sbStdout
+	sbStderr := bytes.Buffer{}
+	sb.Stderr = &sbStderr
+	assert.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	// Traffic on either port wakes the application, and keeps it
+	// awake, and it is ready once both ports are listening
+	for _, port := range []string{"4445", "4444", "4445"} {
+		curl := exec.Command("curl", "-m5", "-sS", "http://127.0.0.1:"+port)
+		curlStdout := bytes.Buffer{}
+		curl.Stdout = &curlStdout
+		curlStderr := bytes.Buffer{}
+		curl.Stderr = &curlStderr
+		assert.NoError(t, curl.Run(), "stderr: %s", curlStderr.String())
+		assert.Contains(t, curlStdout.String(), "Directory listing")
+		time.Sleep(1 * time.Second)
+	}
+	assert.Equal(t, 1, strings.Count(sbStderr.String(), "starting subprocess"))
+	assert.NotContains(t, sbStderr.String(), "stopping subprocess")
+	assert.Contains(t, sbStderr.String(), "also listening on 0.0.0.0:4445, proxying to 127.0.0.1:6667")
+	time.Sleep(3 * time.Second)
+	assert.Contains(t, sbStderr.String(), "stopping subprocess")
+}
+
+func Test_ExtraPortsClientRules(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "sleepingd.yaml")
+	config := `apps:
+  - name: web
+    command: python3 -u -m http.server -b 127.0.0.1 -d / 6666 & exec python3 -u -m http.server -b 127.0.0.1 -d / 6667
+    timeout_seconds: 10
+    command_port: 6666
+    listen_port: 4444
+    extra_ports:
+      - listen_port: 4445
+        command_port: 6667
+        connect_from: ["!127.0.0.1"]
+`
+	require.NoError(t, os.WriteFile(configPath, []byte(config), 0o644))
+	sb := exec.Command("sleepingd", "--config", configPath)
+	sbOutput := bytes.Buffer{}
+	sb.Stdout = &sbOutput
+	sb.Stderr = &sbOutput
+	assert.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	// The extra port has its own rules, which do not let us in,
+	// while the main port uses those of the application
+	curl := exec.Command("curl", "-m5", "-sS", "http://127.0.0.1:4445")
+	assert.Error(t, curl.Run(), "extra port should reset the connection")
+	assert.NotContains(t, sbOutput.String(), "starting subprocess")
+	curl = exec.Command("curl", "-m5", "-sS", "http://127.0.0.1:4444")
+	curlStdout := bytes.Buffer{}
+	curl.Stdout = &curlStdout
+	assert.NoError(t, curl.Run())
+	assert.Contains(t, curlStdout.String(), "Directory listing")
+}
+
+func Test_Drain(t *testing.T) {
+	sb := exec.Command("sleepingd")
+	sb.Env = append(
+		os.Environ(),
+		"SLEEPING_BEAUTY_COMMAND=exec python3 -u ../resources/slow.py 6666",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS=60",
+		"SLEEPING_BEAUTY_COMMAND_PORT=6666",
+		"SLEEPING_BEAUTY_LISTEN_PORT=4444",
+		"SLEEPING_BEAUTY_DRAIN_TIMEOUT_SECONDS=10",
+	)
+	sbStderr := bytes.Buffer{}
+	sb.Stdout = os.Stdout
+	sb.Stderr = &sbStderr
+	require.NoError(t, sb.Start())
+	time.Sleep(500 * time.Millisecond)
+	type result struct {
+		body string
+		err  error
+	}
+	resCh := make(chan result)
+	go func() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		res, err := client.Get("http://127.0.0.1:4444/2")
+		if err != nil {
+			resCh <- result{err: err}
+			return
+		}
+		body, err := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		resCh <- result{body: string(body), err: err}
+	}()
+	time.Sleep(1 * time.Second)
+	require.NoError(t, sb.Process.Signal(syscall.SIGTERM))
+	// The request in progress is allowed to finish
+	res := <-resCh
+	assert.NoError(t, res.err)
+	assert.Equal(t, "done", res.body)
+	done := make(chan struct{})
+	go func() {
+		_ = sb.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		_ = sb.Process.Kill()
+		<-done
+		assert.Fail(t, "sleepingd did not exit after draining")
+	}
+	assert.Contains(t, sbStderr.String(), "[default] draining 1 connections")
+	assert.Contains(t, sbStderr.String(), "[default] all connections finished")
+	assert.Contains(t, sbStderr.String(), "[default] stopping subprocess")
+	time.Sleep(time.Second)
+}
+
+func Test_RestartAfterCrash(t *testing.T) {
+	sb := exec.Command("sleepingd")
+	sb.Env = append(
+		os.Environ(),
+		"SLEEPING_BEAUTY_COMMAND=exec python3 -u ../resources/slow.py 6666",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS=60",
+		"SLEEPING_BEAUTY_COMMAND_PORT=6666",
+		"SLEEPING_BEAUTY_LISTEN_PORT=4444",
+	)
+	sbStderr := bytes.Buffer{}
+	sb.Stdout = os.Stdout
+	sb.Stderr = &sbStderr
+	require.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	client := &http.Client{Timeout: 10 * time.Second}
+	_, err := client.Get("http://127.0.0.1:4444/exit")
+	assert.Error(t, err)
+	time.Sleep(500 * time.Millisecond)
+	// The application is started again for the next request
+	res, err := client.Get("http://127.0.0.1:4444/0")
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "done", string(body))
+	assert.Contains(t, sbStderr.String(), "[default] subprocess exited unexpectedly")
+}
+
+func Test_StartFailure(t *testing.T) {
+	sb := exec.Command("sleepingd")
+	sb.Env = append(
+		os.Environ(),
+		"SLEEPING_BEAUTY_APPS=broken,working",
+		"SLEEPING_BEAUTY_TIMEOUT_SECONDS=60",
+		// Never listens on its command port
+		"SLEEPING_BEAUTY_APP_BROKEN_COMMAND=sleep 60",
+		"SLEEPING_BEAUTY_APP_BROKEN_COMMAND_PORT=6667",
+		"SLEEPING_BEAUTY_APP_BROKEN_LISTEN_PORT=4445",
+		"SLEEPING_BEAUTY_APP_WORKING_COMMAND=python3 -u -m http.server -b 127.0.0.1 -d / 6666",
+		"SLEEPING_BEAUTY_APP_WORKING_COMMAND_PORT=6666",
+		"SLEEPING_BEAUTY_APP_WORKING_LISTEN_PORT=4444",
+	)
+	sbStderr := bytes.Buffer{}
+	sb.Stdout = os.Stdout
+	sb.Stderr = &sbStderr
+	require.NoError(t, sb.Start())
+	defer killNicely(t, sb.Process)
+	time.Sleep(500 * time.Millisecond)
+	curl := exec.Command("curl", "-m5", "-sS", "http://127.0.0.1:4444")
+	require.NoError(t, curl.Run())
+	curl = exec.Command("curl", "-m10", "-sS", "http://127.0.0.1:4445")
+	assert.Error(t, curl.Run())
+	// The daemon and the other application are still running
+	assert.Nil(t, sb.ProcessState)
+	curl = exec.Command("curl", "-m5", "-sS", "http://127.0.0.1:4444")
+	curlStdout := bytes.Buffer{}
+	curl.Stdout = &curlStdout
+	assert.NoError(t, curl.Run())
+	assert.Contains(t, curlStdout.String(), "Directory listing")
+	assert.Contains(t, sbStderr.String(), "error: [broken] process did not start listening on port 6667")
+	assert.Contains(t, sbStderr.String(), "[broken] stopping subprocess")
+	assert.NotContains(t, sbStderr.String(), "[working] stopping subprocess")
+}
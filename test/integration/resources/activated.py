@@ -0,0 +1,36 @@
+# A minimal HTTP server that supports socket activation, see
+# sd_listen_fds(3), for testing handoff mode. It responds with its
+# pid, and exits after being idle for as many seconds as given on the
+# command line.
+
+import http.server
+import os
+import socket
+import sys
+
+assert os.environ["LISTEN_PID"] == str(os.getpid())
+assert os.environ["LISTEN_FDS"] == "1"
+
+
+class Handler(http.server.BaseHTTPRequestHandler):
+    def do_GET(self):
+        body = f"pid {os.getpid()}".encode()
+        self.send_response(200)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+
+class Server(http.server.HTTPServer):
+    idle = False
+
+    def handle_timeout(self):
+        self.idle = True
+
+
+server = Server(("", 0), Handler, bind_and_activate=False)
+server.socket = socket.socket(fileno=3)
+server.timeout = float(sys.argv[1])
+while not server.idle:
+    server.handle_request()
+print("idle, exiting", flush=True)
@@ -0,0 +1,26 @@
+# A minimal HTTP server that takes a while to respond, for testing
+# that requests in progress are allowed to finish. It listens on the
+# port given on the command line, and responds after the number of
+# seconds given in the path, e.g. /2. The path /exit makes it exit
+# right away instead, as if it crashed.
+
+import http.server
+import os
+import sys
+import time
+
+
+class Handler(http.server.BaseHTTPRequestHandler):
+    def do_GET(self):
+        if self.path == "/exit":
+            os._exit(1)
+        time.sleep(float(self.path.strip("/") or "0"))
+        body = b"done"
+        self.send_response(200)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+
+server = http.server.ThreadingHTTPServer(("127.0.0.1", int(sys.argv[1])), Handler)
+server.serve_forever()